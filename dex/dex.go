@@ -0,0 +1,214 @@
+/*
+Package dex runs the blocks of a DexFile from other Go programs.  Unlike
+the dex command it never exits the process or writes to the terminal by
+itself: output goes to the writers in RunOptions, and the outcome of a run
+is returned.  Each run has its own variables, so a File can run several
+blocks at once.
+*/
+package dex
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	v2 "dex/v2"
+)
+
+/* A block path that does not lead to a block */
+type NotFoundError = v2.BlockNotFoundError
+
+/* A block whose os, arch, requires or condition guards keep it from running */
+type GuardError = v2.BlockGuardError
+
+/* Runs the commands of a block, see v2.Executor */
+type Executor = v2.Executor
+
+/* A command for an Executor to run */
+type ExecSpec = v2.ExecSpec
+
+/* The outcome of a command run by an Executor */
+type ExecResult = v2.ExecResult
+
+/* Records commands instead of running them, for tests and dry runs */
+type RecordingExecutor = v2.RecordingExecutor
+
+/* A loaded DexFile */
+type File struct {
+	Path string
+
+	dexFile v2.DexFile2
+}
+
+/* Load and parse the version 2 DexFile at path */
+func Load(path string) (*File, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	file.Path = path
+
+	return file, nil
+}
+
+/* Parse the content of a version 2 DexFile */
+func Parse(data []byte) (*File, error) {
+
+	dexFile, err := v2.ParseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{dexFile: dexFile}, nil
+}
+
+/* A block of the DexFile, with the path that runs it */
+type Block struct {
+	Name     string
+	Desc     string
+	Path     []string
+	Children []Block
+}
+
+/* The blocks of the DexFile, as the menu of the dex command lists them */
+func (file *File) Blocks() []Block {
+	return blocks(file.dexFile.Blocks, nil)
+}
+
+func blocks(list []v2.Block, parent []string) []Block {
+
+	result := []Block{}
+
+	for _, block := range list {
+
+		path := append(append([]string{}, parent...), block.Name)
+
+		result = append(result, Block{
+			Name:     block.Name,
+			Desc:     block.Desc,
+			Path:     path,
+			Children: blocks(block.Children, path),
+		})
+	}
+
+	return result
+}
+
+/*
+Options of a run.  Output written to nil writers is discarded and commands
+read nothing from a nil Stdin.  Dir is where commands run unless blocks
+set their own, the current directory when empty.  Env is added to the
+environment of commands and seen by from-env variables, and Vars override
+the variables of the DexFile and the block.
+*/
+type RunOptions struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Dir    string
+	Env    map[string]string
+	Vars   map[string]any
+
+	/* Report skipped commands, and silence diag and note messages */
+	Verbose bool
+	Quiet   bool
+
+	/* Stop the run after Timeout, and kill commands that did not exit
+	   GracePeriod after they were signalled */
+	Timeout     time.Duration
+	GracePeriod time.Duration
+
+	/* File the history is logged to, nothing is logged when empty */
+	LogFile string
+
+	/* Where the fingerprints of blocks with sources are kept.  Blocks
+	   always run when it is empty, or when Force is set */
+	StateDir string
+	Force    bool
+
+	/* Runs the commands instead of local processes when set */
+	Executor Executor
+
+	/* Where blocks and commands with confirm read the answer, and whether
+	   to answer yes without asking.  They are declined without either */
+	Prompt io.Reader
+	Yes    bool
+}
+
+/* The outcome of a run */
+type Result struct {
+	/* Exit code of the block, like the dex command exits with */
+	Exit int
+
+	Duration time.Duration
+
+	/* The blocks and commands that ran or were skipped, in order */
+	Timings []Timing
+}
+
+/* How long a block or command took */
+type Timing struct {
+	Block    []string
+	Command  string
+	Skipped  bool
+	Exit     int
+	Duration time.Duration
+	Depth    int
+}
+
+/*
+Run the block at path.  The error is only set when the block did not run
+at all: it does not exist (*NotFoundError), its guards failed (*GuardError),
+a variable override is invalid or ctx was done before it started.  Once
+the block runs, its commands failing or ctx being cancelled only show in
+the exit code of the result.
+*/
+func (file *File) Run(ctx context.Context, path []string, options RunOptions) (Result, error) {
+
+	start := time.Now()
+
+	result, err := v2.RunBlock(ctx, file.dexFile, path, v2.RunOptions{
+		Stdin:       options.Stdin,
+		Stdout:      options.Stdout,
+		Stderr:      options.Stderr,
+		Dir:         options.Dir,
+		Env:         options.Env,
+		Vars:        options.Vars,
+		Verbose:     options.Verbose,
+		Quiet:       options.Quiet,
+		Color:       "never",
+		Timeout:     options.Timeout,
+		GracePeriod: options.GracePeriod,
+		LogFile:     options.LogFile,
+		StateDir:    options.StateDir,
+		Force:       options.Force,
+		Executor:    options.Executor,
+		Prompt:      options.Prompt,
+		Yes:         options.Yes,
+		Timings:     true,
+	})
+
+	timings := []Timing{}
+
+	for _, entry := range result.Timings.Entries() {
+		timings = append(timings, Timing{
+			Block:    entry.Block,
+			Command:  entry.Command,
+			Skipped:  entry.Status == "skipped",
+			Exit:     entry.Exit,
+			Duration: time.Duration(entry.Duration * float64(time.Second)),
+			Depth:    entry.Depth,
+		})
+	}
+
+	return Result{Exit: result.Exit, Duration: time.Since(start), Timings: timings}, err
+}
@@ -0,0 +1,261 @@
+package dex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDexFile = `---
+version: 2
+vars:
+  target: staging
+  token:
+    from-env: DEPLOY_TOKEN
+    default: none
+blocks:
+  - name: deploy
+    desc: deploy the app
+    vars:
+      replicas: 2
+    commands:
+      - exec: echo deploying to [% target %] with [% replicas %] replicas
+      - exec: echo token [% token %] region $REGION
+      - exec: pwd
+  - name: server
+    desc: manage the server
+    children:
+      - name: restart
+        desc: restart the server
+        commands:
+          - exec: echo restarting; exit 3
+  - name: unix
+    desc: only on plan9
+    os: [plan9]
+    commands:
+      - exec: echo never
+  - name: slow
+    desc: takes a while
+    commands:
+      - exec: sleep 10
+`
+
+func TestLoad(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "dex.yaml")
+	os.WriteFile(path, []byte(testDexFile), 0644)
+
+	file, err := Load(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, path, file.Path)
+
+	blocks := file.Blocks()
+
+	if assert.Len(t, blocks, 4) {
+		assert.Equal(t, "deploy", blocks[0].Name)
+		assert.Equal(t, "deploy the app", blocks[0].Desc)
+		assert.Equal(t, []string{"server", "restart"}, blocks[1].Children[0].Path)
+	}
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+
+	os.WriteFile(path, []byte("version: 1\n"), 0644)
+
+	_, err = Load(path)
+	assert.ErrorContains(t, err, "incorrect version number")
+}
+
+func TestRun(t *testing.T) {
+
+	file, err := Parse([]byte(testDexFile))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dir := t.TempDir()
+
+	tests := []struct {
+		Name     string
+		Path     []string
+		Options  RunOptions
+		Exit     int
+		Output   string
+		Error    any
+		Commands int
+	}{
+		{
+			Name: "env, vars and dir",
+			Path: []string{"deploy"},
+			Options: RunOptions{
+				Dir:  dir,
+				Env:  map[string]string{"DEPLOY_TOKEN": "secret", "REGION": "eu"},
+				Vars: map[string]any{"target": "prod", "replicas": 5},
+			},
+			Output:   "deploying to prod with 5 replicas\ntoken secret region eu\n" + dir + "\n",
+			Commands: 3,
+		},
+		{
+			Name:     "defaults",
+			Path:     []string{"deploy"},
+			Options:  RunOptions{Dir: dir},
+			Output:   "deploying to staging with 2 replicas\ntoken none region\n" + dir + "\n",
+			Commands: 3,
+		},
+		{
+			Name:     "exit code",
+			Path:     []string{"server", "restart"},
+			Exit:     3,
+			Output:   "restarting\n",
+			Commands: 1,
+		},
+		{
+			Name:  "not found",
+			Path:  []string{"server", "stop"},
+			Exit:  1,
+			Error: &NotFoundError{},
+		},
+		{
+			Name:  "nil path",
+			Path:  nil,
+			Exit:  1,
+			Error: &NotFoundError{},
+		},
+		{
+			Name:  "empty path",
+			Path:  []string{},
+			Exit:  1,
+			Error: &NotFoundError{},
+		},
+		{
+			Name:  "guards",
+			Path:  []string{"unix"},
+			Exit:  1,
+			Error: &GuardError{},
+		},
+		{
+			Name:     "timeout",
+			Path:     []string{"slow"},
+			Options:  RunOptions{Timeout: 100 * time.Millisecond, GracePeriod: 100 * time.Millisecond},
+			Exit:     124,
+			Commands: 1,
+		},
+	}
+
+	for _, test := range tests {
+
+		var output bytes.Buffer
+
+		test.Options.Stdout = &output
+
+		result, err := file.Run(context.Background(), test.Path, test.Options)
+
+		switch expected := test.Error.(type) {
+		case *NotFoundError:
+			assert.True(t, errors.As(err, &expected), test.Name)
+		case *GuardError:
+			assert.True(t, errors.As(err, &expected), test.Name)
+		default:
+			assert.NoError(t, err, test.Name)
+		}
+
+		assert.Equal(t, test.Exit, result.Exit, test.Name)
+		assert.Equal(t, test.Output, output.String(), test.Name)
+
+		commands := 0
+		for _, timing := range result.Timings {
+			if len(timing.Command) > 0 {
+				commands++
+			}
+		}
+
+		assert.Equal(t, test.Commands, commands, test.Name)
+	}
+}
+
+func TestRunConcurrently(t *testing.T) {
+
+	file, err := Parse([]byte(testDexFile))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	targets := []string{"alpha", "beta", "gamma", "delta"}
+	outputs := make([]bytes.Buffer, len(targets))
+
+	var wait sync.WaitGroup
+
+	for index, target := range targets {
+		wait.Add(1)
+
+		go func(index int, target string) {
+			defer wait.Done()
+
+			file.Run(context.Background(), []string{"deploy"}, RunOptions{
+				Stdout: &outputs[index],
+				Vars:   map[string]any{"target": target},
+			})
+		}(index, target)
+	}
+
+	wait.Wait()
+
+	for index, target := range targets {
+		assert.Contains(t, outputs[index].String(), "deploying to "+target+" with 2 replicas\n", target)
+	}
+}
+
+/* Problems with the DexFile go to the Stderr of the run, never to the process */
+func TestRunStderr(t *testing.T) {
+
+	file, err := Parse([]byte(`---
+version: 2
+blocks:
+  - name: invalid
+    desc: has an invalid retry
+    commands:
+      - exec: echo '{{' "{{ .Names }}" [% name %]
+        retry:
+          attempts: x
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	processStderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	saved := os.Stderr
+	os.Stderr = processStderr
+
+	var output, stderr bytes.Buffer
+
+	result, err := file.Run(context.Background(), []string{"invalid"}, RunOptions{
+		Stdout: &output,
+		Stderr: &stderr,
+		Vars:   map[string]any{"name": "web1"},
+	})
+
+	os.Stderr = saved
+	processStderr.Close()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Exit)
+	assert.Equal(t, "{{ {{ .Names }} web1\n", output.String())
+	assert.Contains(t, stderr.String(), "dex: invalid retry attempts x\n")
+
+	written, _ := os.ReadFile(processStderr.Name())
+	assert.Empty(t, string(written))
+}
@@ -33,6 +33,7 @@ func main() {
 		v1.Run(dexFile, os.Args)
 		/* Attempt parsing as v2 */
 	} else if dexFile, err := v2.ParseConfig(dexData); err == nil {
+		dexFile.Path = filename
 		v2.Run(dexFile, os.Args)
 		/* failure */
 	} else {
@@ -0,0 +1,165 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Options of RunBlock.  Output written to nil writers is discarded.  Env is
+added to the environment of the commands and seen by from-env variables,
+and Vars override the variables of the DexFile and the block.
+*/
+type RunOptions struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Dir    string
+	Env    map[string]string
+	Vars   map[string]any
+
+	Verbose bool
+	Quiet   bool
+	Color   string
+
+	Timeout     time.Duration
+	GracePeriod time.Duration
+
+	/* Context of finally and on-failure commands, ctx without its cancel when nil */
+	Cleanup context.Context
+
+	/* File the history is logged to, nothing is logged when empty */
+	LogFile string
+
+	/* Where the fingerprints of blocks with sources are kept, none are when empty */
+	StateDir string
+	Force    bool
+
+	Timings bool
+
+	/* Runs the commands, a LocalExecutor when nil */
+	Executor Executor
+
+	/* Give commands the terminal on stdin, only for the dex command as it
+	   interrupts the whole process when they are stopped by Ctrl-C */
+	Foreground bool
+
+	/* Where confirm prompts read the answer, declined when nil, and
+	   whether to answer yes without asking */
+	Prompt io.Reader
+	Yes    bool
+}
+
+/* The outcome of RunBlock, with the timings when they were asked for */
+type RunResult struct {
+	Exit    int
+	Timings *TimingReport
+}
+
+/*
+Run the block at blockPath in a scope of its own, without the global
+variables of the command line, so blocks can run side by side.  The error
+is only set when the block did not run at all: it does not exist, its
+guards failed, a variable override is invalid or ctx was done first.
+*/
+func RunBlock(ctx context.Context, dexFile DexFile2, blockPath []string, options RunOptions) (RunResult, error) {
+
+	config := ExecConfig{
+		Stdin:       options.Stdin,
+		Stdout:      options.Stdout,
+		Stderr:      options.Stderr,
+		Dir:         options.Dir,
+		Verbose:     options.Verbose,
+		Quiet:       options.Quiet,
+		Color:       options.Color,
+		GracePeriod: options.GracePeriod,
+		Cleanup:     options.Cleanup,
+		File:        &dexFile,
+		Path:        blockPath,
+		StateDir:    options.StateDir,
+		Force:       options.Force,
+		Executor:    options.Executor,
+		Foreground:  options.Foreground,
+		Prompt:      options.Prompt,
+		Yes:         options.Yes,
+	}
+
+	if config.Stdout == nil {
+		config.Stdout = io.Discard
+	}
+
+	if config.Stderr == nil {
+		config.Stderr = io.Discard
+	}
+
+	config.Secrets = &secretValues{}
+
+	for name, value := range options.Env {
+		config.Env = append(config.Env, name+"="+value)
+	}
+
+	sort.Strings(config.Env)
+
+	overrides := map[string]VarCfg{}
+
+	for name, value := range options.Vars {
+		varCfg, err := newVarCfg(value)
+		if err != nil {
+			return RunResult{Exit: 2}, fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+
+		overrides[name] = varCfg
+	}
+
+	ctx, cancel := withTimeout(ctx, options.Timeout)
+	defer cancel()
+
+	config.Context = ctx
+
+	scope := map[string]VarCfg{}
+	initScopeVars(scope, dexFile.Vars, config)
+
+	/* Overrides of secret variables stay secret */
+	for name, varCfg := range overrides {
+		if scope[name].Secret {
+			varCfg.Secret = true
+			overrides[name] = varCfg
+			config.Secrets.add(name, varCfg, config.Stderr)
+		}
+	}
+
+	maps.Copy(scope, overrides)
+
+	block, err := initBlockWithVars(dexFile, blockPath, scope, overrides, config)
+
+	if exit := cancelExitCodeFor(ctx); exit != 0 {
+		return RunResult{Exit: exit}, context.Cause(ctx)
+	} else if err != nil {
+		return RunResult{Exit: 1}, err
+	}
+
+	config.Vars = scope
+	config.Calls = []string{strings.Join(blockPath, " ")}
+
+	if len(options.LogFile) > 0 {
+		if logger, err := newExecLogger(options.LogFile); err != nil {
+			fmt.Fprintf(config.Stderr, "dex: cannot write history: %v\n", err)
+		} else {
+			config.Logger = logger
+			defer logger.Close()
+		}
+	}
+
+	if options.Timings {
+		config.Timings = &TimingReport{}
+	}
+
+	exit := processBlock(block, config)
+
+	return RunResult{Exit: exit, Timings: config.Timings}, nil
+}
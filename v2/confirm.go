@@ -0,0 +1,129 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+/*
+What a block or command with confirm would run, rendered with the
+variables: every iteration of the commands that run something.
+*/
+func confirmPlan(commands []Command, varCfgs map[string]VarCfg) []string {
+
+	plan := []string{}
+
+	for _, command := range commands {
+
+		if len(command.Exec) == 0 && len(command.Script) == 0 && len(command.Run) == 0 {
+			continue
+		}
+
+		iterations, err := command.Iterations(varCfgs)
+		if err != nil {
+			continue
+		}
+
+		for _, iteration := range iterations {
+			iterationVars := map[string]VarCfg{}
+
+			maps.Copy(iterationVars, varCfgs)
+			maps.Copy(iterationVars, iteration)
+
+			plan = append(plan, commandLabel(command, iterationVars))
+		}
+	}
+
+	return plan
+}
+
+/*
+Ask whether to go ahead with the plan.  The answer is read from the
+Prompt of config, and is y or yes, or the phrase when there is one.
+--yes answers for the user, and without a Prompt, like when dex does not
+run on a terminal, the question is declined.
+*/
+func confirm(question, phrase string, plan []string, config ExecConfig) bool {
+
+	if config.Yes {
+		return true
+	}
+
+	if config.Prompt == nil {
+		fmt.Fprintf(config.Stderr, "dex: %s declined, not on a terminal: pass --yes to confirm\n", question)
+		return false
+	}
+
+	fmt.Fprintf(config.Stderr, "dex: %s\n", question)
+
+	for _, line := range plan {
+		fmt.Fprintf(config.Stderr, "  %s\n", config.Secrets.redact(line))
+	}
+
+	if len(phrase) > 0 {
+		fmt.Fprintf(config.Stderr, "Type %q to continue: ", phrase)
+	} else {
+		fmt.Fprintf(config.Stderr, "Continue? [y/N] ")
+	}
+
+	/* The read is left behind when the run is interrupted, dex is exiting then */
+	answers := make(chan string, 1)
+
+	go func() {
+		answers <- readAnswer(config)
+	}()
+
+	ctx := config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var answer string
+
+	select {
+	case answer = <-answers:
+	case <-ctx.Done():
+		fmt.Fprintln(config.Stderr)
+		return false
+	}
+
+	answer = strings.TrimSpace(answer)
+
+	if len(phrase) > 0 && answer == phrase {
+		return true
+	}
+
+	if len(phrase) == 0 && (strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")) {
+		return true
+	}
+
+	fmt.Fprintf(config.Stderr, "dex: %s declined\n", question)
+
+	return false
+}
+
+/* Read a line of the prompt a byte at a time, leaving the rest for commands */
+func readAnswer(config ExecConfig) string {
+
+	var line strings.Builder
+
+	buffer := make([]byte, 1)
+
+	for {
+		n, err := config.Prompt.Read(buffer)
+
+		if n > 0 && buffer[0] == '\n' {
+			break
+		} else if n > 0 {
+			line.WriteByte(buffer[0])
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return line.String()
+}
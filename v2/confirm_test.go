@@ -0,0 +1,132 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirm(t *testing.T) {
+
+	config := `---
+version: 2
+vars:
+  env: production
+blocks:
+  - name: deploy
+    desc: this is a command description
+    confirm: Deploy to [% env %]?
+    commands:
+      - diag: deploying
+      - exec: echo deployed to [% env %]
+      - exec: echo restarted [% var %]
+        for-vars: [web1, web2]
+  - name: drop
+    desc: this is a command description
+    confirm: Drop the database?
+    confirm-phrase: "[% env %]"
+    commands:
+      - exec: echo dropped
+  - name: steps
+    desc: this is a command description
+    commands:
+      - exec: echo built
+      - exec: echo pushed [% var %]
+        for-vars: [a, b]
+        confirm: Push [% var %]?
+      - exec: echo never
+    finally:
+      - exec: echo cleaned up
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		Name   string
+		Path   string
+		Prompt io.Reader
+		Yes    bool
+		Exit   int
+		Stdout string
+		Stderr string
+	}{
+		{
+			Name:   "yes",
+			Path:   "deploy",
+			Prompt: strings.NewReader("y\n"),
+			Stdout: "deploying\ndeployed to production\nrestarted web1\nrestarted web2\n",
+			Stderr: "dex: Deploy to production?\n" +
+				"  echo deployed to production\n  echo restarted web1\n  echo restarted web2\n" +
+				"Continue? [y/N] ",
+		},
+		{
+			Name:   "no",
+			Path:   "deploy",
+			Prompt: strings.NewReader("\n"),
+			Exit:   1,
+			Stderr: "dex: Deploy to production?\n" +
+				"  echo deployed to production\n  echo restarted web1\n  echo restarted web2\n" +
+				"Continue? [y/N] dex: Deploy to production? declined\n",
+		},
+		{
+			Name:   "not on a terminal",
+			Path:   "deploy",
+			Exit:   1,
+			Stderr: "dex: Deploy to production? declined, not on a terminal: pass --yes to confirm\n",
+		},
+		{
+			Name:   "--yes",
+			Path:   "deploy",
+			Yes:    true,
+			Stdout: "deploying\ndeployed to production\nrestarted web1\nrestarted web2\n",
+		},
+		{
+			Name:   "phrase",
+			Path:   "drop",
+			Prompt: strings.NewReader("production\n"),
+			Stdout: "dropped\n",
+			Stderr: "dex: Drop the database?\n  echo dropped\nType \"production\" to continue: ",
+		},
+		{
+			Name:   "wrong phrase",
+			Path:   "drop",
+			Prompt: strings.NewReader("y\n"),
+			Exit:   1,
+			Stderr: "dex: Drop the database?\n  echo dropped\nType \"production\" to continue: dex: Drop the database? declined\n",
+		},
+		{
+			Name:   "commands",
+			Path:   "steps",
+			Prompt: strings.NewReader("y\nno\n"),
+			Exit:   1,
+			Stdout: "built\npushed a\ncleaned up\n",
+			Stderr: "dex: Push a?\n  echo pushed a\nContinue? [y/N] " +
+				"dex: Push b?\n  echo pushed b\nContinue? [y/N] dex: Push b? declined\n",
+		},
+	}
+
+	for _, test := range tests {
+
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+
+		result, err := RunBlock(context.Background(), dexFile, []string{test.Path}, RunOptions{
+			Stdout: &stdout,
+			Stderr: &stderr,
+			Prompt: test.Prompt,
+			Yes:    test.Yes,
+		})
+
+		assert.NoError(t, err, test.Name)
+		assert.Equal(t, test.Exit, result.Exit, test.Name)
+		assert.Equal(t, test.Stdout, stdout.String(), test.Name)
+		assert.Equal(t, test.Stderr, stderr.String(), test.Name)
+	}
+}
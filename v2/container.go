@@ -0,0 +1,223 @@
+package v2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"sort"
+)
+
+/*
+The container commands run in, with the docker or podman command line.
+The project directory is mounted at the same path, and commands run in
+their dir unless the container sets a workdir.  Fields are rendered, so
+loops can pick images.
+*/
+type Container struct {
+	Image   string
+	Engine  string
+	Volumes []string
+	Workdir string
+	Env     []string
+	User    string
+}
+
+/* Container engines, in the order they are looked for on PATH */
+var containerEngines = []string{"docker", "podman"}
+
+/* Whether commands run in a container at all */
+func (container Container) IsSet() bool {
+	return len(container.Image) > 0
+}
+
+/*
+Parse the container attribute of a command or block.  Takes a map of the
+container options, or an image as a shorthand.  The env is a map or a
+list of KEY=value.
+*/
+func parseContainer(value any) (Container, error) {
+
+	container := Container{}
+
+	switch typeVal := value.(type) {
+	case nil:
+		return container, nil
+
+	case string:
+		container.Image = typeVal
+
+	case map[string]any:
+		if image, ok := typeVal["image"].(string); ok {
+			container.Image = image
+		} else {
+			return Container{}, errors.New("container needs an image")
+		}
+
+		assignIfSet(typeVal, "engine", &container.Engine)
+		assignIfSet(typeVal, "volumes", &container.Volumes)
+		assignIfSet(typeVal, "workdir", &container.Workdir)
+		assignIfSet(typeVal, "user", &container.User)
+
+		switch env := typeVal["env"].(type) {
+		case nil:
+		case map[string]any:
+			for name, value := range env {
+				container.Env = append(container.Env, fmt.Sprintf("%s=%v", name, value))
+			}
+
+			sort.Strings(container.Env)
+		default:
+			assignIfSet(typeVal, "env", &container.Env)
+		}
+
+		if len(container.Engine) > 0 && !slices.Contains(containerEngines, container.Engine) {
+			return Container{}, fmt.Errorf("invalid container engine %q, expected docker or podman", container.Engine)
+		}
+
+	default:
+		return Container{}, fmt.Errorf("invalid container %v", value)
+	}
+
+	return container, nil
+}
+
+/*
+An executor running commands in the container, rendered with the variables,
+through inner.  projectDir, the base directory of the run, is mounted.
+*/
+func (container Container) executor(varCfgs map[string]VarCfg, projectDir string, inner Executor) Executor {
+
+	rendered := Container{
+		Image:   render(container.Image, varCfgs),
+		Engine:  container.Engine,
+		Workdir: render(container.Workdir, varCfgs),
+		User:    render(container.User, varCfgs),
+	}
+
+	for _, volume := range container.Volumes {
+		rendered.Volumes = append(rendered.Volumes, render(volume, varCfgs))
+	}
+
+	for _, env := range container.Env {
+		rendered.Env = append(rendered.Env, render(env, varCfgs))
+	}
+
+	return &ContainerExecutor{Container: rendered, ProjectDir: projectDir, Inner: inner}
+}
+
+/*
+Runs commands in a new container each, removed when the command is done.
+The engine is run by Inner, a LocalExecutor when nil.  Without an engine
+set, a LocalExecutor runs the first one on PATH and other executors, like
+the RecordingExecutor of --dry-run, run docker.
+*/
+type ContainerExecutor struct {
+	Container  Container
+	ProjectDir string
+	Inner      Executor
+}
+
+func (executor *ContainerExecutor) Run(ctx context.Context, spec ExecSpec) ExecResult {
+
+	inner := executor.Inner
+	if inner == nil {
+		inner = LocalExecutor{}
+	}
+
+	engine := executor.Container.Engine
+
+	if _, local := inner.(LocalExecutor); !local {
+		checkSetDefault(&engine, containerEngines[0])
+	}
+
+	if len(engine) == 0 {
+		for _, name := range containerEngines {
+			if _, err := exec.LookPath(name); err == nil {
+				engine = name
+				break
+			}
+		}
+	}
+
+	if len(engine) == 0 {
+		fmt.Fprintf(spec.Stderr, "dex: neither docker nor podman is on PATH\n")
+		return ExecResult{Exit: 127}
+	}
+
+	/* A name to remove the container by when the engine is killed */
+	token := make([]byte, 6)
+	rand.Read(token)
+
+	name := "dex-" + hex.EncodeToString(token)
+
+	args := []string{"run", "--rm", "--init", "--name", name}
+
+	if spec.Stdin != nil {
+		args = append(args, "--interactive")
+	}
+
+	if len(executor.ProjectDir) > 0 {
+		args = append(args, "--volume", executor.ProjectDir+":"+executor.ProjectDir)
+	}
+
+	/* Scripts and the like are written to files on this machine */
+	for _, file := range spec.Files {
+		args = append(args, "--volume", file+":"+file+":ro")
+	}
+
+	for _, volume := range executor.Container.Volumes {
+		args = append(args, "--volume", volume)
+	}
+
+	workdir := executor.Container.Workdir
+	checkSetDefault(&workdir, spec.Dir)
+
+	if len(workdir) > 0 {
+		args = append(args, "--workdir", workdir)
+	}
+
+	if len(executor.Container.User) > 0 {
+		args = append(args, "--user", executor.Container.User)
+	}
+
+	for _, env := range append(slices.Clone(spec.Env), executor.Container.Env...) {
+		args = append(args, "--env", env)
+	}
+
+	args = append(args, executor.Container.Image, spec.Cmd)
+	args = append(args, spec.Args...)
+
+	result := inner.Run(ctx, ExecSpec{
+		Cmd:         engine,
+		Args:        args,
+		Dir:         executor.ProjectDir,
+		Stdin:       spec.Stdin,
+		Stdout:      spec.Stdout,
+		Stderr:      spec.Stderr,
+		GracePeriod: spec.GracePeriod,
+		Foreground:  spec.Foreground,
+		Redact:      spec.Redact,
+	})
+
+	/* The engine was stopped, which does not always stop the container */
+	if result.Err != nil {
+		cleanup, cancel := withTimeout(context.WithoutCancel(ctx), DefaultGracePeriod)
+		defer cancel()
+
+		inner.Run(cleanup, ExecSpec{
+			Cmd:    engine,
+			Args:   []string{"rm", "--force", name},
+			Dir:    executor.ProjectDir,
+			Stdout: io.Discard,
+			Stderr: io.Discard,
+			Redact: spec.Redact,
+		})
+	}
+
+	return result
+}
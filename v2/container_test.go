@@ -0,0 +1,247 @@
+package v2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* Logs its arguments, then runs the command after the image on this machine */
+const stubDocker = `#!/bin/sh
+echo "$@" >> "$DEX_DOCKER_LOG"
+[ "$1" = run ] || exit 0
+shift
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--rm|--init|--interactive) shift ;;
+	--workdir) cd "$2"; shift 2 ;;
+	--env) export "$2"; shift 2 ;;
+	--*) shift 2 ;;
+	*) break ;;
+	esac
+done
+shift
+exec "$@"
+`
+
+func TestParseContainer(t *testing.T) {
+
+	tests := []struct {
+		Value    any
+		Expected Container
+		Error    string
+	}{
+		{
+			Value:    "alpine:3",
+			Expected: Container{Image: "alpine:3"},
+		},
+		{
+			Value: map[string]any{
+				"image":   "golang:1.22",
+				"engine":  "podman",
+				"volumes": []any{"cache:/root/.cache"},
+				"workdir": "/src",
+				"env":     map[string]any{"GOOS": "linux", "CGO_ENABLED": 0},
+				"user":    1000,
+			},
+			Expected: Container{
+				Image:   "golang:1.22",
+				Engine:  "podman",
+				Volumes: []string{"cache:/root/.cache"},
+				Workdir: "/src",
+				Env:     []string{"CGO_ENABLED=0", "GOOS=linux"},
+				User:    "1000",
+			},
+		},
+		{
+			Value:    map[string]any{"image": "alpine", "env": []any{"A=1", "B=2"}},
+			Expected: Container{Image: "alpine", Env: []string{"A=1", "B=2"}},
+		},
+		{
+			Value: map[string]any{"volumes": []any{"a:/a"}},
+			Error: "container needs an image",
+		},
+		{
+			Value: map[string]any{"image": "alpine", "engine": "lxc"},
+			Error: `invalid container engine "lxc", expected docker or podman`,
+		},
+	}
+
+	for _, test := range tests {
+
+		container, err := parseContainer(test.Value)
+
+		if len(test.Error) > 0 {
+			assert.EqualError(t, err, test.Error)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, test.Expected, container)
+	}
+}
+
+func TestContainer(t *testing.T) {
+
+	stubs := t.TempDir()
+	os.WriteFile(filepath.Join(stubs, "docker"), []byte(stubDocker), 0755)
+
+	t.Setenv("PATH", stubs+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		DexTest
+		Exit int
+		Log  string
+	}{
+		{
+			DexTest: DexTest{
+				Name: "block container",
+				Config: `---
+version: 2
+blocks:
+  - name: build
+    desc: this is a command description
+    container:
+      image: golang:1.22
+      env:
+        GOFLAGS: -mod=vendor
+      volumes: [gocache:/root/.cache]
+      user: "1000"
+    commands:
+      - exec: echo $GOFLAGS; exit 3
+`,
+				BlockPath:  []string{"build"},
+				CommandOut: "-mod=vendor\n",
+			},
+			Exit: 3,
+			Log: `^run --rm --init --name dex-[0-9a-f]+ --volume (\S+):(\S+) --volume gocache:/root/.cache ` +
+				`--workdir \S+ --user 1000 --env GOFLAGS=-mod=vendor golang:1.22 /bin/bash -c echo \$GOFLAGS; exit 3
+$`,
+		},
+		{
+			DexTest: DexTest{
+				Name: "command containers",
+				Config: `---
+version: 2
+blocks:
+  - name: build
+    desc: this is a command description
+    commands:
+      - exec: echo on the host
+      - exec: echo in [% var %]
+        for-vars: [alpine, debian]
+        container:
+          image: "[% var %]:latest"
+          engine: docker
+          workdir: /
+      - script: |
+          echo from a script in $PWD
+        container: alpine
+        dir: /
+`,
+				BlockPath:  []string{"build"},
+				CommandOut: "on the host\nin alpine\nin debian\nfrom a script in /\n",
+			},
+			Log: `^run .* --workdir / alpine:latest /bin/bash -c echo in alpine
+run .* --workdir / debian:latest /bin/bash -c echo in debian
+run .* --volume (\S+dex-script-\S+):(\S+):ro --workdir / alpine /bin/bash \S+dex-script-\S+
+$`,
+		},
+		{
+			DexTest: DexTest{
+				Name: "timeout",
+				Config: `---
+version: 2
+blocks:
+  - name: build
+    desc: this is a command description
+    timeout: 200ms
+    container: alpine
+    commands:
+      - exec: sleep 5
+`,
+				BlockPath: []string{"build"},
+			},
+			Exit: ExitTimeout,
+			Log: `^run --rm --init --name (dex-[0-9a-f]+) .* alpine /bin/bash -c sleep 5
+rm --force dex-[0-9a-f]+
+$`,
+		},
+	}
+
+	for _, test := range tests {
+
+		logFile := filepath.Join(t.TempDir(), "docker.log")
+		t.Setenv("DEX_DOCKER_LOG", logFile)
+
+		block, tDexFile, err := setupTestBlock(t, test.DexTest)
+
+		defer os.Remove(tDexFile.Name())
+
+		if !assert.NoError(t, err, test.Name) {
+			continue
+		}
+
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+
+		exit := processBlock(block, ExecConfig{Stdout: &stdout, Stderr: &stderr, GracePeriod: DefaultGracePeriod})
+
+		log, _ := os.ReadFile(logFile)
+
+		assert.Equal(t, test.Exit, exit, test.Name)
+		assert.Equal(t, test.CommandOut, stdout.String(), test.Name)
+		assert.Regexp(t, regexp.MustCompile(test.Log), string(log), test.Name)
+	}
+}
+
+/* The base directory of the run is mounted, and recording needs no engine on PATH */
+func TestContainerRecorded(t *testing.T) {
+
+	t.Setenv("PATH", t.TempDir())
+
+	dexFile, err := ParseConfig([]byte(`---
+version: 2
+blocks:
+  - name: build
+    desc: this is a command description
+    commands:
+      - exec: make
+        container: alpine
+      - exec: make
+        container:
+          image: alpine
+          engine: podman
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	block, err := initBlockWithVars(dexFile, []string{"build"}, map[string]VarCfg{}, nil, ExecConfig{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	recorder := &RecordingExecutor{}
+	dir := t.TempDir()
+
+	var output bytes.Buffer
+
+	exit := processBlock(block, ExecConfig{Stdout: &output, Stderr: &output, Dir: dir, Executor: recorder})
+
+	assert.Equal(t, 0, exit, output.String())
+
+	specs := recorder.Specs()
+
+	if assert.Len(t, specs, 2) {
+		assert.Equal(t, "docker", specs[0].Cmd)
+		assert.Equal(t, "podman", specs[1].Cmd)
+
+		assert.Regexp(t, ` --volume `+regexp.QuoteMeta(dir+":"+dir)+` --workdir `+regexp.QuoteMeta(dir)+` alpine `, specs[0].String())
+		assert.Equal(t, dir, specs[0].Dir)
+	}
+}
@@ -0,0 +1,81 @@
+package v2
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+Levels of the messages commands print with diag, note, warn and error, in
+the order they are printed when a command has several.  Warnings and
+errors go to stderr and only diag and note are silenced by --quiet.
+*/
+var diagLevels = []struct {
+	Key    string
+	Prefix string
+	Color  string
+	Stderr bool
+	Quiet  bool
+}{
+	{Key: "diag", Quiet: true},
+	{Key: "note", Prefix: "note: ", Color: "\033[36m", Quiet: true},
+	{Key: "warn", Prefix: "warning: ", Color: "\033[33m", Stderr: true},
+	{Key: "error", Prefix: "error: ", Color: "\033[31m", Stderr: true},
+}
+
+/* Values of --color */
+var colorModes = []string{"auto", "always", "never"}
+
+/* Whether messages to the writer are colored for the --color mode */
+func diagColor(w io.Writer, mode string) bool {
+
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return useColor(w)
+	}
+}
+
+/*
+Write the messages of a command.  Diag and note go to stdout, unless it is
+redirected away from the terminal while stderr is not, so that the output
+of commands can be captured without the messages.  An output file of the
+block or command gets them either way.
+*/
+func writeDiags(command Command, varCfgs map[string]VarCfg, config ExecConfig) {
+
+	messages := map[string]string{
+		"diag":  command.Diag,
+		"note":  command.Note,
+		"warn":  command.Warn,
+		"error": command.Error,
+	}
+
+	for _, level := range diagLevels {
+
+		message := messages[level.Key]
+		if len(message) == 0 || (level.Quiet && config.Quiet) {
+			continue
+		}
+
+		w := config.Stdout
+		if level.Stderr || (!config.OutputFile && !isTerminal(config.Stdout) && isTerminal(config.Stderr)) {
+			w = config.Stderr
+		}
+
+		if w == nil {
+			continue
+		}
+
+		message = level.Prefix + config.Secrets.redact(render(message, varCfgs))
+
+		if len(level.Color) > 0 && diagColor(w, config.Color) {
+			message = level.Color + message + "\033[0m"
+		}
+
+		fmt.Fprintln(w, message)
+	}
+}
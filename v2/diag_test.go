@@ -0,0 +1,78 @@
+package v2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagLevels(t *testing.T) {
+
+	test := DexTest{
+		Config: `---
+version: 2
+vars:
+  host: web1
+blocks:
+  - name: diag
+    desc: this is a command description
+    commands:
+      - diag: deploying to [% host %]
+        note: this can take a while
+      - warn: "[% host %] is not drained"
+      - error: giving up
+        exec: echo done
+`,
+		BlockPath: []string{"diag"},
+	}
+
+	tests := []struct {
+		Name   string
+		Config ExecConfig
+		Stdout string
+		Stderr string
+	}{
+		{
+			Name:   "levels",
+			Config: ExecConfig{Color: "auto"},
+			Stdout: "deploying to web1\nnote: this can take a while\ndone\n",
+			Stderr: "warning: web1 is not drained\nerror: giving up\n",
+		},
+		{
+			Name:   "quiet",
+			Config: ExecConfig{Quiet: true},
+			Stdout: "done\n",
+			Stderr: "warning: web1 is not drained\nerror: giving up\n",
+		},
+		{
+			Name:   "color",
+			Config: ExecConfig{Color: "always"},
+			Stdout: "deploying to web1\n\033[36mnote: this can take a while\033[0m\ndone\n",
+			Stderr: "\033[33mwarning: web1 is not drained\033[0m\n\033[31merror: giving up\033[0m\n",
+		},
+	}
+
+	for _, elem := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			return
+		}
+
+		var stdout, stderr bytes.Buffer
+
+		config := elem.Config
+		config.Stdout = &stdout
+		config.Stderr = &stderr
+
+		processBlock(block, config)
+
+		assert.Equal(t, elem.Stdout, stdout.String(), elem.Name)
+		assert.Equal(t, elem.Stderr, stderr.String(), elem.Name)
+	}
+}
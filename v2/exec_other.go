@@ -0,0 +1,28 @@
+//go:build !unix
+
+package v2
+
+import (
+	"os"
+	"os/exec"
+)
+
+/* Process groups are not available, signals only reach the command itself */
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+
+	if sig == os.Interrupt {
+		return cmd.Process.Kill()
+	}
+
+	return cmd.Process.Signal(sig)
+}
+
+var terminateSignal = os.Kill
+
+var forwardSignals = []os.Signal{os.Interrupt}
+
+func signalExitCode(sig os.Signal) int {
+	return 130
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package v2
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+/* Put the command in its own process group so signals reach everything it starts */
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+/* Send a signal to the process group of a command started with setProcessGroup */
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+
+	if unixSig, ok := sig.(syscall.Signal); ok {
+		return syscall.Kill(-cmd.Process.Pid, unixSig)
+	}
+
+	return cmd.Process.Signal(sig)
+}
+
+/* Signal sent to commands when a timeout fires */
+var terminateSignal os.Signal = syscall.SIGTERM
+
+/* Signals dex forwards to the commands it runs */
+var forwardSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+/* Shells report death by signal as 128 plus the signal number */
+func signalExitCode(sig os.Signal) int {
+
+	if unixSig, ok := sig.(syscall.Signal); ok {
+		return 128 + int(unixSig)
+	}
+
+	return 1
+}
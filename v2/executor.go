@@ -0,0 +1,252 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* A command for an Executor to run: a program, its arguments and where and how to run it */
+type ExecSpec struct {
+	Cmd    string
+	Args   []string
+	Dir    string
+	Env    []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	/* Local files the command reads, like scripts, for executors that
+	   run it elsewhere to bring along */
+	Files []string
+
+	/* How long the command gets to exit after a signal before it is killed */
+	GracePeriod time.Duration
+
+	/* Give the process group of the command the terminal on stdin, for
+	   the dex command.  Programs embedding dex keep their terminal */
+	Foreground bool
+
+	/* Hides the secrets in text about the command, for executors that
+	   show it.  Text is kept as it is when nil */
+	Redact func(text string) string
+}
+
+/* Characters that make an argument need quotes in a shell */
+var shellSpecial = regexp.MustCompile(`[^\w@%+=:,./-]`)
+
+/* The command line of the spec, with its secrets redacted */
+func (spec ExecSpec) redacted() string {
+
+	if spec.Redact == nil {
+		return spec.String()
+	}
+
+	return spec.Redact(spec.String())
+}
+
+/* The command line of the spec, quoted for a POSIX shell */
+func (spec ExecSpec) String() string {
+
+	words := []string{}
+
+	for _, word := range append([]string{spec.Cmd}, spec.Args...) {
+		if len(word) == 0 || shellSpecial.MatchString(word) {
+			word = shellQuote(word)
+		}
+
+		words = append(words, word)
+	}
+
+	return strings.Join(words, " ")
+}
+
+/*
+The outcome of a command.  Err is only set when the command was stopped by
+a timeout or interrupt, and Exit is then ExitTimeout or 128 plus the
+signal number.
+*/
+type ExecResult struct {
+	Exit int
+	Err  error
+}
+
+/*
+Runs the commands of dex.  Run returns when the command is done, and stops
+the command when ctx is done, with the cause of ctx as the error.
+*/
+type Executor interface {
+	Run(ctx context.Context, spec ExecSpec) ExecResult
+}
+
+/* Executors blocks can choose by name with executor: */
+var executors = map[string]Executor{
+	"local": LocalExecutor{},
+}
+
+var executorsMutex sync.Mutex
+
+/* Make an executor available to blocks with executor: name */
+func RegisterExecutor(name string, executor Executor) {
+
+	executorsMutex.Lock()
+	defer executorsMutex.Unlock()
+
+	executors[name] = executor
+}
+
+func lookupExecutor(name string) (Executor, error) {
+
+	executorsMutex.Lock()
+	defer executorsMutex.Unlock()
+
+	if executor, ok := executors[name]; ok {
+		return executor, nil
+	}
+
+	names := []string{}
+	for known := range executors {
+		names = append(names, known)
+	}
+
+	slices.Sort(names)
+
+	return nil, fmt.Errorf("unknown executor %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+/* Runs commands as processes on this machine, the default */
+type LocalExecutor struct{}
+
+func (LocalExecutor) Run(ctx context.Context, spec ExecSpec) ExecResult {
+
+	grace := spec.GracePeriod
+	if grace <= 0 {
+		grace = DefaultGracePeriod
+	}
+
+	cmd := exec.CommandContext(ctx, spec.Cmd, spec.Args...)
+	cmd.Stdin = spec.Stdin
+	cmd.Env = commandEnv(spec.Env)
+	cmd.Stdout = spec.Stdout
+	cmd.Stderr = spec.Stderr
+	cmd.Dir = spec.Dir
+	cmd.WaitDelay = grace
+
+	/* Commands get their own process group so a timeout or signal reaches
+	   everything they start.  When the dex command runs on a terminal the
+	   group gets the terminal, so commands can still prompt on it and the
+	   terminal delivers Ctrl-C to them itself.  Where that is not supported
+	   they stay in the group of dex instead. */
+	foreground := spec.Foreground && isTerminal(os.Stdin)
+
+	group := !foreground || foregroundSupported
+	if group {
+		setProcessGroup(cmd)
+	}
+
+	if group && foreground {
+		setForeground(cmd)
+	}
+
+	cmd.Cancel = func() error {
+
+		sig := terminateSignal
+
+		var interruptErr *InterruptError
+		if errors.As(context.Cause(ctx), &interruptErr) {
+			if !group && interruptErr.Signal == os.Interrupt {
+				return nil
+			}
+
+			sig = interruptErr.Signal
+		}
+
+		if group {
+			return signalProcessGroup(cmd, sig)
+		}
+
+		return cmd.Process.Signal(sig)
+	}
+
+	err := cmd.Run()
+
+	/* The signal handler of dex cancels the run soon, this command already stopped */
+	if group && foreground && restoreForeground(cmd) {
+		interrupt := &InterruptError{Signal: os.Interrupt}
+
+		return ExecResult{Exit: cancelExitCode(interrupt), Err: interrupt}
+	}
+
+	if ctx.Err() != nil {
+		/* Anything left in the group after the grace period is killed */
+		if group && cmd.Process != nil {
+			signalProcessGroup(cmd, os.Kill)
+		}
+
+		cause := context.Cause(ctx)
+
+		return ExecResult{Exit: cancelExitCode(cause), Err: cause}
+	}
+
+	if err != nil {
+
+		if exitError, ok := err.(*exec.ExitError); ok {
+			return ExecResult{Exit: exitError.ExitCode()}
+		} else {
+			return ExecResult{Exit: 1}
+		}
+	}
+
+	return ExecResult{}
+}
+
+/*
+Records the commands it is given instead of running them, for tests and
+--dry-run.  Each command is written to Output when it is set, and Result
+decides its outcome, success when it is nil.
+*/
+type RecordingExecutor struct {
+	Output io.Writer
+	Result func(spec ExecSpec) ExecResult
+
+	mutex sync.Mutex
+	specs []ExecSpec
+}
+
+func (executor *RecordingExecutor) Run(ctx context.Context, spec ExecSpec) ExecResult {
+
+	executor.mutex.Lock()
+	executor.specs = append(executor.specs, spec)
+	executor.mutex.Unlock()
+
+	if executor.Output != nil {
+		fmt.Fprintf(executor.Output, "dex: would run %s in %s\n", spec.redacted(), spec.Dir)
+	}
+
+	if err := context.Cause(ctx); err != nil {
+		return ExecResult{Exit: cancelExitCode(err), Err: err}
+	}
+
+	if executor.Result != nil {
+		return executor.Result(spec)
+	}
+
+	return ExecResult{}
+}
+
+/* The commands recorded so far */
+func (executor *RecordingExecutor) Specs() []ExecSpec {
+
+	executor.mutex.Lock()
+	defer executor.mutex.Unlock()
+
+	return slices.Clone(executor.specs)
+}
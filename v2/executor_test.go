@@ -0,0 +1,208 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecSpecString(t *testing.T) {
+
+	tests := []struct {
+		Spec     ExecSpec
+		Expected string
+	}{
+		{
+			Spec:     ExecSpec{Cmd: "/bin/bash", Args: []string{"-c", "echo hello"}},
+			Expected: "/bin/bash -c 'echo hello'",
+		},
+		{
+			Spec:     ExecSpec{Cmd: "ls", Args: []string{"-la", "src/main.go", "key=value", ""}},
+			Expected: "ls -la src/main.go key=value ''",
+		},
+		{
+			Spec:     ExecSpec{Cmd: "echo", Args: []string{"it's $HOME"}},
+			Expected: `echo 'it'\''s $HOME'`,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.Expected, test.Spec.String())
+	}
+}
+
+func TestRecordingExecutor(t *testing.T) {
+
+	config := `---
+version: 2
+vars:
+  version:
+    from-command: git describe
+    default: v0.0.0
+blocks:
+  - name: release
+    desc: this is a command description
+    dir: /srv
+    commands:
+      - exec: make release VERSION=[% version %]
+        for-vars: [linux, darwin]
+      - exec: upload [% var %]
+        condition-shell: -f dist/[% var %]
+        for-vars: [linux, darwin]
+      - exec: git rev-parse HEAD
+        register: commit
+      - diag: released [% commit %]
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var plan bytes.Buffer
+	var output bytes.Buffer
+
+	executor := &RecordingExecutor{
+		Output: &plan,
+		Result: func(spec ExecSpec) ExecResult {
+			last := spec.Args[len(spec.Args)-1]
+
+			switch {
+			case last == "git describe":
+				spec.Stdout.Write([]byte("v1.2.3\n"))
+			case last == "git rev-parse HEAD":
+				spec.Stdout.Write([]byte("abc123\n"))
+			case strings.HasPrefix(last, "test ") && strings.Contains(last, "darwin"):
+				return ExecResult{Exit: 1}
+			}
+
+			return ExecResult{}
+		},
+	}
+
+	result, err := RunBlock(context.Background(), dexFile, []string{"release"}, RunOptions{
+		Stdout:   &output,
+		Stderr:   &output,
+		Env:      map[string]string{"CI": "true"},
+		Executor: executor,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Exit)
+	assert.Equal(t, "released abc123\n", output.String())
+
+	commands := []string{}
+	for _, spec := range executor.Specs() {
+		commands = append(commands, spec.Args[len(spec.Args)-1])
+		assert.Equal(t, []string{"CI=true"}, spec.Env)
+	}
+
+	assert.Equal(t, []string{
+		"git describe",
+		"make release VERSION=v1.2.3",
+		"make release VERSION=v1.2.3",
+		"test -f dist/linux",
+		"upload linux",
+		"test -f dist/darwin",
+		"git rev-parse HEAD",
+	}, commands)
+
+	assert.Equal(t, "/srv", executor.Specs()[1].Dir)
+	assert.Contains(t, plan.String(), "dex: would run /bin/bash -c 'upload linux' in /srv\n")
+}
+
+func TestBlockExecutor(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: fake
+    desc: this is a command description
+    executor: fake
+    session: true
+    commands:
+      - exec: export GREETING=hello
+      - exec: echo $GREETING
+  - name: unknown
+    desc: this is a command description
+    executor: teleport
+    commands:
+      - exec: echo never
+`
+
+	recorder := &RecordingExecutor{}
+	RegisterExecutor("fake", recorder)
+
+	for _, test := range []struct {
+		Path   string
+		Exit   int
+		Output string
+		Specs  int
+	}{
+		{
+			Path:  "fake",
+			Specs: 2,
+		},
+		{
+			Path:   "unknown",
+			Exit:   1,
+			Output: "dex: unknown executor \"teleport\", expected one of fake, local\n",
+		},
+	} {
+
+		block, tDexFile, err := setupTestBlock(t, DexTest{Config: config, BlockPath: []string{test.Path}})
+
+		defer os.Remove(tDexFile.Name())
+
+		if !assert.NoError(t, err, test.Path) {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		exit := processBlock(block, ExecConfig{Stdout: &output, Stderr: &output})
+
+		assert.Equal(t, test.Exit, exit, test.Path)
+		assert.Equal(t, test.Output, output.String(), test.Path)
+	}
+
+	/* Every command went to the executor, none to a session */
+	assert.Len(t, recorder.Specs(), 2)
+}
+
+func TestDryRunBlockExecutor(t *testing.T) {
+
+	marker := filepath.Join(t.TempDir(), "ran")
+
+	config := `---
+version: 2
+blocks:
+  - name: local
+    desc: this is a command description
+    executor: local
+    commands:
+      - exec: touch ` + marker + `
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var plan bytes.Buffer
+
+	recorder := &RecordingExecutor{Output: &plan}
+
+	result, err := RunBlock(context.Background(), dexFile, []string{"local"}, RunOptions{Executor: recorder})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Exit)
+	assert.NoFileExists(t, marker)
+	assert.Len(t, recorder.Specs(), 1)
+	assert.Contains(t, plan.String(), "dex: would run /bin/bash -c 'touch "+marker+"'")
+}
@@ -0,0 +1,720 @@
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+Condition expressions are evaluated by dex itself rather than shelling out
+to test.  The language is small:
+
+	literals:    "string", 'string', 12, -1.5, true, false, [a, "b", 3]
+	variables:   name, db.host, hosts.0, os, arch
+	operators:   == != < > <= >= in matches && || ! and parentheses
+	functions:   exists(path), defined(name)
+
+Values are VarCfgs so typed variables keep their type when compared.
+*/
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value VarCfg
+}
+
+/* Operators, longest first so that == is matched before = */
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func isIdentRune(r rune, first bool) bool {
+	if first {
+		return unicode.IsLetter(r) || r == '_'
+	}
+
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
+}
+
+func tokenize(expr string) ([]token, error) {
+
+	tokens := []token{}
+	runes := []rune(expr)
+
+	for pos := 0; pos < len(runes); {
+		r := runes[pos]
+
+		switch {
+		case unicode.IsSpace(r):
+			pos++
+
+		case r == '"' || r == '\'':
+			end := pos + 1
+			for end < len(runes) && runes[end] != r {
+				if runes[end] == '\\' && r == '"' {
+					end++
+				}
+				end++
+			}
+
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string starting at %d", pos)
+			}
+
+			text := string(runes[pos+1 : end])
+
+			if r == '"' {
+				unquoted, err := strconv.Unquote(string(runes[pos : end+1]))
+				if err != nil {
+					return nil, fmt.Errorf("invalid string %s: %v", string(runes[pos:end+1]), err)
+				}
+				text = unquoted
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: text, value: VarCfg{Type: StringVar, StringValue: text}})
+			pos = end + 1
+
+		case unicode.IsDigit(r) || (r == '-' && pos+1 < len(runes) && unicode.IsDigit(runes[pos+1])):
+			end := pos + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+
+			text := string(runes[pos:end])
+			value := VarCfg{}
+
+			if intVal, err := strconv.ParseInt(text, 10, 64); err == nil {
+				SetVarValue(&value, intVal)
+			} else if floatVal, err := strconv.ParseFloat(text, 64); err == nil {
+				SetVarValue(&value, floatVal)
+			} else {
+				return nil, fmt.Errorf("invalid number %s", text)
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: text, value: value})
+			pos = end
+
+		case isIdentRune(r, true):
+			end := pos + 1
+			for end < len(runes) && isIdentRune(runes[end], false) {
+				end++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[pos:end])})
+			pos = end
+
+		default:
+			matched := false
+
+			for _, op := range exprOperators {
+				if strings.HasPrefix(string(runes[pos:]), op) {
+					tokens = append(tokens, token{kind: tokenOp, text: op})
+					pos += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", r, pos)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+/* Parsed expression tree */
+type exprNode interface {
+	eval(env exprEnv) (VarCfg, error)
+}
+
+type literalNode struct {
+	value VarCfg
+}
+
+type identNode struct {
+	name string
+}
+
+type listNode struct {
+	elems []exprNode
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+
+	return tok
+}
+
+/* Whether the next token is one of the given operators */
+func (p *exprParser) isOp(ops ...string) bool {
+	tok := p.peek()
+
+	return tok.kind == tokenOp && slices.Contains(ops, tok.text)
+}
+
+/* Whether the next token is one of the given word operators */
+func (p *exprParser) isKeyword(words ...string) bool {
+	tok := p.peek()
+
+	return tok.kind == tokenIdent && slices.Contains(words, tok.text)
+}
+
+func (p *exprParser) expect(op string) error {
+	if tok := p.next(); tok.kind != tokenOp || tok.text != op {
+		return fmt.Errorf("expected %q but found %q", op, tok.text)
+	}
+
+	return nil
+}
+
+/* Parse a condition expression into a tree that can be evaluated */
+func parseExpr(expr string) (exprNode, error) {
+
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &exprParser{tokens: tokens}
+
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := parser.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q", tok.text)
+	}
+
+	return node, nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("||") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = binaryNode{op: "||", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("&&") {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = binaryNode{op: "&&", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+
+	if p.isOp("!") {
+		p.next()
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return unaryNode{op: "!", operand: operand}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isOp("==", "!=", "<", ">", "<=", ">=") || p.isKeyword("in", "matches") {
+		op := p.next().text
+
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+
+		return binaryNode{op: op, left: left, right: right}, nil
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+
+	tok := p.next()
+
+	switch tok.kind {
+	case tokenString, tokenNumber:
+		return literalNode{value: tok.value}, nil
+
+	case tokenIdent:
+		switch tok.text {
+		case "true", "false":
+			return literalNode{value: VarCfg{Type: BoolVar, BoolValue: tok.text == "true"}}, nil
+		}
+
+		if p.isOp("(") {
+			p.next()
+
+			args, err := p.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+
+			return callNode{name: tok.text, args: args}, nil
+		}
+
+		return identNode{name: tok.text}, nil
+
+	case tokenOp:
+		switch tok.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			return node, p.expect(")")
+
+		case "[":
+			elems, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+
+			return listNode{elems: elems}, nil
+		}
+	}
+
+	if tok.kind == tokenEOF {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+/* Parse comma separated expressions up to the closing token */
+func (p *exprParser) parseList(closing string) ([]exprNode, error) {
+
+	elems := []exprNode{}
+
+	if p.isOp(closing) {
+		p.next()
+		return elems, nil
+	}
+
+	for {
+		elem, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		elems = append(elems, elem)
+
+		if p.isOp(",") {
+			p.next()
+			continue
+		}
+
+		return elems, p.expect(closing)
+	}
+}
+
+/* Variables and working directory available while evaluating */
+type exprEnv struct {
+	vars map[string]VarCfg
+	dir  string
+}
+
+/* Variables provided by dex when not defined in the dex file */
+func builtinVar(name string) (VarCfg, bool) {
+
+	switch name {
+	case "os":
+		return VarCfg{Type: StringVar, StringValue: runtime.GOOS}, true
+	case "arch":
+		return VarCfg{Type: StringVar, StringValue: runtime.GOARCH}, true
+	}
+
+	return VarCfg{}, false
+}
+
+func (env exprEnv) lookup(name string) (VarCfg, bool) {
+
+	if varCfg, ok := lookupVar(env.vars, name); ok {
+		return varCfg, true
+	}
+
+	return builtinVar(name)
+}
+
+func (node literalNode) eval(env exprEnv) (VarCfg, error) {
+	return node.value, nil
+}
+
+func (node identNode) eval(env exprEnv) (VarCfg, error) {
+	varCfg, _ := env.lookup(node.name)
+	return varCfg, nil
+}
+
+func (node listNode) eval(env exprEnv) (VarCfg, error) {
+
+	list := make([]VarCfg, 0, len(node.elems))
+
+	for _, elem := range node.elems {
+		value, err := elem.eval(env)
+		if err != nil {
+			return VarCfg{}, err
+		}
+
+		list = append(list, value)
+	}
+
+	return VarCfg{Type: ListVar, ListValue: list}, nil
+}
+
+func (node unaryNode) eval(env exprEnv) (VarCfg, error) {
+
+	value, err := node.operand.eval(env)
+	if err != nil {
+		return VarCfg{}, err
+	}
+
+	return VarCfg{Type: BoolVar, BoolValue: !truthy(value)}, nil
+}
+
+func (node callNode) eval(env exprEnv) (VarCfg, error) {
+
+	if len(node.args) != 1 {
+		return VarCfg{}, fmt.Errorf("%s() takes one argument", node.name)
+	}
+
+	switch node.name {
+	case "defined":
+		ident, ok := node.args[0].(identNode)
+		if !ok {
+			return VarCfg{}, errors.New("defined() takes a variable name")
+		}
+
+		_, found := env.lookup(ident.name)
+
+		return VarCfg{Type: BoolVar, BoolValue: found}, nil
+
+	case "exists":
+		value, err := node.args[0].eval(env)
+		if err != nil {
+			return VarCfg{}, err
+		}
+
+		path := value.String()
+		if !filepath.IsAbs(path) && len(env.dir) > 0 {
+			path = filepath.Join(env.dir, path)
+		}
+
+		_, statErr := os.Stat(path)
+
+		return VarCfg{Type: BoolVar, BoolValue: len(value.String()) > 0 && statErr == nil}, nil
+	}
+
+	return VarCfg{}, fmt.Errorf("unknown function %s()", node.name)
+}
+
+/*
+Evaluate an operand of a comparison.  A bare word that is not a variable is
+an error there, as a rendered "[% var %] == skip" or a misspelled name would
+otherwise compare undefined with undefined.  defined() tests for absence.
+*/
+func evalOperand(node exprNode, env exprEnv) (VarCfg, error) {
+
+	if ident, ok := node.(identNode); ok {
+		if _, found := env.lookup(ident.name); !found {
+			return VarCfg{}, fmt.Errorf("undefined variable %s, quote it to use it as a string", ident.name)
+		}
+	}
+
+	return node.eval(env)
+}
+
+func (node binaryNode) eval(env exprEnv) (VarCfg, error) {
+
+	evalSide := evalOperand
+
+	/* The logical operators treat undefined variables as false */
+	if node.op == "&&" || node.op == "||" {
+		evalSide = exprNode.eval
+	}
+
+	left, err := evalSide(node.left, env)
+	if err != nil {
+		return VarCfg{}, err
+	}
+
+	/* Short circuit the logical operators */
+	switch node.op {
+	case "&&":
+		if !truthy(left) {
+			return VarCfg{Type: BoolVar, BoolValue: false}, nil
+		}
+	case "||":
+		if truthy(left) {
+			return VarCfg{Type: BoolVar, BoolValue: true}, nil
+		}
+	}
+
+	right, err := evalSide(node.right, env)
+	if err != nil {
+		return VarCfg{}, err
+	}
+
+	result := false
+
+	switch node.op {
+	case "&&", "||":
+		result = truthy(right)
+	case "==":
+		result = valuesEqual(left, right)
+	case "!=":
+		result = !valuesEqual(left, right)
+	case "<", ">", "<=", ">=":
+		cmp, err := compareValues(left, right)
+		if err != nil {
+			return VarCfg{}, err
+		}
+
+		switch node.op {
+		case "<":
+			result = cmp < 0
+		case ">":
+			result = cmp > 0
+		case "<=":
+			result = cmp <= 0
+		case ">=":
+			result = cmp >= 0
+		}
+	case "in":
+		result = containsValue(right, left)
+	case "matches":
+		re, err := regexp.Compile(right.String())
+		if err != nil {
+			return VarCfg{}, fmt.Errorf("invalid pattern %q: %v", right.String(), err)
+		}
+
+		result = left.Type != UndefinedVar && re.MatchString(left.String())
+	}
+
+	return VarCfg{Type: BoolVar, BoolValue: result}, nil
+}
+
+/* Whether a value counts as true when used as a condition */
+func truthy(value VarCfg) bool {
+
+	switch value.Type {
+	case BoolVar:
+		return value.BoolValue
+	case StringVar:
+		return len(value.StringValue) > 0 && value.StringValue != "false" && value.StringValue != "0"
+	case IntVar:
+		return value.IntValue != 0
+	case FloatVar:
+		return value.FloatValue != 0
+	case ListVar:
+		return len(value.ListValue) > 0
+	case MapVar:
+		return len(value.MapValue) > 0
+	}
+
+	return false
+}
+
+/* Numeric value of ints, floats and strings that look like numbers */
+func numericValue(value VarCfg) (float64, bool) {
+
+	switch value.Type {
+	case IntVar:
+		return float64(value.IntValue), true
+	case FloatVar:
+		return value.FloatValue, true
+	case StringVar:
+		if floatVal, err := strconv.ParseFloat(strings.TrimSpace(value.StringValue), 64); err == nil {
+			return floatVal, true
+		}
+	}
+
+	return 0, false
+}
+
+func isNumber(value VarCfg) bool {
+	return value.Type == IntVar || value.Type == FloatVar
+}
+
+func valuesEqual(left, right VarCfg) bool {
+
+	if left.Type == UndefinedVar || right.Type == UndefinedVar {
+		return left.Type == right.Type
+	}
+
+	/* Compare numerically when either side is a number */
+	if isNumber(left) || isNumber(right) {
+		leftNum, leftOk := numericValue(left)
+		rightNum, rightOk := numericValue(right)
+
+		if leftOk && rightOk {
+			return leftNum == rightNum
+		}
+	}
+
+	if left.Type == ListVar || left.Type == MapVar || right.Type == ListVar || right.Type == MapVar {
+		leftVal, _ := left.Value()
+		rightVal, _ := right.Value()
+
+		return reflect.DeepEqual(leftVal, rightVal)
+	}
+
+	return left.String() == right.String()
+}
+
+func compareValues(left, right VarCfg) (int, error) {
+
+	if left.Type == UndefinedVar || right.Type == UndefinedVar {
+		return 0, errors.New("cannot compare undefined value")
+	}
+
+	leftNum, leftOk := numericValue(left)
+	rightNum, rightOk := numericValue(right)
+
+	if leftOk && rightOk {
+		switch {
+		case leftNum < rightNum:
+			return -1, nil
+		case leftNum > rightNum:
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+
+	if left.Type == StringVar && right.Type == StringVar {
+		return strings.Compare(left.StringValue, right.StringValue), nil
+	}
+
+	return 0, fmt.Errorf("cannot compare %s with %s", left.String(), right.String())
+}
+
+/* Membership for lists, keys of maps and substrings of strings */
+func containsValue(container, elem VarCfg) bool {
+
+	switch container.Type {
+	case ListVar:
+		for _, item := range container.ListValue {
+			if valuesEqual(item, elem) {
+				return true
+			}
+		}
+	case MapVar:
+		_, ok := container.MapValue[elem.String()]
+		return ok
+	case StringVar:
+		return elem.Type != UndefinedVar && strings.Contains(container.StringValue, elem.String())
+	}
+
+	return false
+}
+
+/*
+Render the condition template and evaluate it as an expression.  An empty
+condition is always true.
+*/
+func evalCondition(condition string, varCfgs map[string]VarCfg, dir string) (bool, error) {
+
+	if len(strings.TrimSpace(condition)) == 0 {
+		return true, nil
+	}
+
+	node, err := parseExpr(render(condition, varCfgs))
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q: %v", condition, err)
+	}
+
+	value, err := node.eval(exprEnv{vars: varCfgs, dir: dir})
+	if err != nil {
+		return false, fmt.Errorf("condition %q: %v", condition, err)
+	}
+
+	return truthy(value), nil
+}
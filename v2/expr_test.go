@@ -0,0 +1,103 @@
+package v2
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalCondition(t *testing.T) {
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "present.txt"), []byte("hi"), 0644)
+
+	varCfgs := map[string]VarCfg{}
+	values := map[string]any{
+		"name":    "web1",
+		"count":   3,
+		"ratio":   0.5,
+		"enabled": true,
+		"empty":   "",
+		"hosts":   []any{"web1", "web2", 3},
+		"db":      map[string]any{"host": "localhost", "port": 5432},
+	}
+
+	for key, value := range values {
+		varCfgs[key], _ = newVarCfg(value)
+	}
+
+	tests := []struct {
+		Condition string
+		Expected  bool
+		Error     bool
+	}{
+		{Condition: "", Expected: true},
+		{Condition: "true", Expected: true},
+		{Condition: "false", Expected: false},
+		{Condition: `name == "web1"`, Expected: true},
+		{Condition: `name == 'web1'`, Expected: true},
+		{Condition: `name != "web1"`, Expected: false},
+		{Condition: "count == 3", Expected: true},
+		{Condition: "count == 3.0", Expected: true},
+		{Condition: `count == "3"`, Expected: true},
+		{Condition: "count > 2 && count < 4", Expected: true},
+		{Condition: "count >= 4 || ratio <= 0.5", Expected: true},
+		{Condition: "ratio < -1", Expected: false},
+		{Condition: "enabled", Expected: true},
+		{Condition: "!enabled", Expected: false},
+		{Condition: "empty", Expected: false},
+		{Condition: "enabled == true", Expected: true},
+		{Condition: "!(count == 3 && enabled)", Expected: false},
+		{Condition: `"web2" in hosts`, Expected: true},
+		{Condition: "3 in hosts", Expected: true},
+		{Condition: `"web3" in hosts`, Expected: false},
+		{Condition: `name in ["web1", "web9"]`, Expected: true},
+		{Condition: `"host" in db`, Expected: true},
+		{Condition: `"eb" in name`, Expected: true},
+		{Condition: "hosts.1 == \"web2\"", Expected: true},
+		{Condition: "db.port == 5432", Expected: true},
+		{Condition: `db.host matches "^local"`, Expected: true},
+		{Condition: `name matches "^db"`, Expected: false},
+		{Condition: "defined(name)", Expected: true},
+		{Condition: "defined(db.host)", Expected: true},
+		{Condition: "defined(db.user)", Expected: false},
+		{Condition: "!missing", Expected: true},
+		{Condition: "missing || enabled", Expected: true},
+		{Condition: `exists("present.txt")`, Expected: true},
+		{Condition: `exists("absent.txt")`, Expected: false},
+		{Condition: `os == "` + runtime.GOOS + `"`, Expected: true},
+		{Condition: `arch == "` + runtime.GOARCH + `"`, Expected: true},
+		{Condition: `"[% name %]" == "web1"`, Expected: true},
+		{Condition: "count >", Error: true},
+		{Condition: "count > missing", Error: true},
+		{Condition: "missing == missing", Error: true},
+		{Condition: `missing == ""`, Error: true},
+		{Condition: `"web1" in missing`, Error: true},
+		{Condition: `missing matches "^web"`, Error: true},
+		{Condition: "[% name %] == web1", Error: true},
+		{Condition: "[% name %] == staging", Error: true},
+		{Condition: "[% name %] != staging", Error: true},
+		{Condition: `"[% name %]" != "staging"`, Expected: true},
+		{Condition: `"[% name %]" == "staging"`, Expected: false},
+		{Condition: `name matches "("`, Error: true},
+		{Condition: `"unterminated`, Error: true},
+		{Condition: "nope(1)", Error: true},
+		{Condition: "count = 3", Error: true},
+	}
+
+	for _, test := range tests {
+
+		result, err := evalCondition(test.Condition, varCfgs, dir)
+
+		if test.Error {
+			assert.Error(t, err, test.Condition)
+			continue
+		}
+
+		assert.NoError(t, err, test.Condition)
+		assert.Equal(t, test.Expected, result, test.Condition)
+	}
+}
@@ -0,0 +1,127 @@
+//go:build linux
+
+package v2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* Open a pseudo terminal, returning its master and slave ends */
+func openPty() (*os.File, *os.File, error) {
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unlock := int32(0)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		return nil, nil, errno
+	}
+
+	number := uint32(0)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number))); errno != 0 {
+		master.Close()
+		return nil, nil, errno
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	return master, slave, nil
+}
+
+/* The process group the terminal on stdin gives its input to */
+func terminalForeground() int {
+
+	pgrp := int32(0)
+	syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+
+	return int(pgrp)
+}
+
+/*
+Commands only get the terminal when they ask for it with Foreground, and a
+Ctrl-C that stopped them then interrupts dex as well.  The test runs again
+as the session leader of a pseudo terminal to have one to give away.
+*/
+func TestForeground(t *testing.T) {
+
+	if os.Getenv("DEX_TEST_FOREGROUND") == "1" {
+		foregroundOnTerminal(t)
+		return
+	}
+
+	master, slave, err := openPty()
+	if err != nil {
+		t.Skipf("no pseudo terminal: %v", err)
+	}
+
+	defer master.Close()
+	defer slave.Close()
+
+	var output bytes.Buffer
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestForeground$", "-test.v")
+	cmd.Env = append(os.Environ(), "DEX_TEST_FOREGROUND=1")
+	cmd.Stdin = slave
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+
+	assert.NoError(t, cmd.Run(), output.String())
+}
+
+func foregroundOnTerminal(t *testing.T) {
+
+	if !assert.True(t, isTerminal(os.Stdin)) {
+		return
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, syscall.SIGINT)
+	defer signal.Stop(interrupted)
+
+	/* The command stops itself like a Ctrl-C on the terminal would */
+	spec := ExecSpec{Cmd: "/bin/sh", Args: []string{"-c", "kill -INT $$"}}
+
+	result := LocalExecutor{}.Run(context.Background(), spec)
+
+	assert.NotZero(t, result.Exit)
+	assert.NoError(t, result.Err)
+	assert.Equal(t, syscall.Getpgrp(), terminalForeground())
+
+	select {
+	case <-interrupted:
+		t.Error("interrupted without Foreground")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	spec.Foreground = true
+	result = LocalExecutor{}.Run(context.Background(), spec)
+
+	assert.Equal(t, 130, result.Exit)
+	assert.Equal(t, &InterruptError{Signal: os.Interrupt}, result.Err)
+	assert.Equal(t, syscall.Getpgrp(), terminalForeground())
+
+	select {
+	case <-interrupted:
+	case <-time.After(time.Second):
+		t.Error("not interrupted with Foreground")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package v2
+
+import (
+	"os/exec"
+)
+
+/* Commands on a terminal stay in the process group of dex instead */
+const foregroundSupported = false
+
+func setForeground(cmd *exec.Cmd) {}
+
+func restoreForeground(cmd *exec.Cmd) bool {
+	return false
+}
@@ -0,0 +1,47 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package v2
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+/* Whether commands in a process group of their own can have the terminal */
+const foregroundSupported = true
+
+/* Make the process group of a command from setProcessGroup the foreground group of the terminal on stdin */
+func setForeground(cmd *exec.Cmd) {
+	cmd.SysProcAttr.Foreground = true
+	cmd.SysProcAttr.Ctty = int(os.Stdin.Fd())
+}
+
+/*
+Take the terminal back once a command run with setForeground is done.  A
+Ctrl-C on the terminal only reached the command, so dex is interrupted
+too, as if it had still shared the terminal, and true is returned.
+*/
+func restoreForeground(cmd *exec.Cmd) bool {
+
+	/* dex is in the background until then, and would be stopped for taking it */
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	pgrp := syscall.Getpgrp()
+
+	syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&pgrp)))
+
+	if cmd.ProcessState == nil {
+		return false
+	}
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGINT {
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		return true
+	}
+
+	return false
+}
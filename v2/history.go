@@ -0,0 +1,249 @@
+package v2
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+One line of the execution log.  Every command that runs gets a command
+entry, and every block a block entry once it is done.  Entries of the same
+invocation of dex share the run id.
+*/
+type HistoryEntry struct {
+	Run      string    `json:"run"`
+	Event    string    `json:"event"`
+	Block    []string  `json:"block"`
+	Command  string    `json:"command,omitempty"`
+	Dir      string    `json:"dir,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"`
+	Exit     int       `json:"exit"`
+	User     string    `json:"user"`
+	Host     string    `json:"host"`
+}
+
+/* Writes the execution log as JSON lines.  A nil logger logs nothing */
+type ExecLogger struct {
+	Path string
+
+	mutex sync.Mutex
+	file  *os.File
+	run   string
+	user  string
+	host  string
+}
+
+/* The directory dex keeps its state in, following the XDG base directories */
+func stateDir() (string, error) {
+
+	if dir := os.Getenv("XDG_STATE_HOME"); len(dir) > 0 {
+		return filepath.Join(dir, "dex"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".local", "state", "dex"), nil
+}
+
+/* The log file from DEX_LOG_FILE, or history.jsonl in the state directory */
+func defaultLogFile() string {
+
+	if path, ok := os.LookupEnv("DEX_LOG_FILE"); ok {
+		return path
+	}
+
+	dir, err := stateDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "history.jsonl")
+}
+
+/* Create a logger appending to the file at path, which is created when needed */
+func newExecLogger(path string) (*ExecLogger, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := &ExecLogger{
+		Path: path,
+		file: file,
+		run:  fmt.Sprintf("%x-%d", time.Now().UnixNano(), os.Getpid()),
+	}
+
+	if current, err := user.Current(); err == nil {
+		logger.user = current.Username
+	}
+
+	logger.host, _ = os.Hostname()
+
+	return logger, nil
+}
+
+func (logger *ExecLogger) log(entry HistoryEntry) {
+
+	if logger == nil || logger.file == nil {
+		return
+	}
+
+	entry.Run = logger.run
+	entry.End = time.Now()
+	entry.Duration = entry.End.Sub(entry.Start).Seconds()
+	entry.User = logger.user
+	entry.Host = logger.host
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	logger.file.Write(append(line, '\n'))
+}
+
+/* Log a command that ran from start until now */
+func (logger *ExecLogger) logCommand(config ExecConfig, command string, start time.Time, exit int) {
+	logger.log(HistoryEntry{Event: "command", Block: config.Secrets.redactPath(config.Path), Command: config.Secrets.redact(command), Dir: config.Dir, Start: start, Exit: exit})
+}
+
+/* Log a block that ran from start until now */
+func (logger *ExecLogger) logBlock(config ExecConfig, start time.Time, exit int) {
+	logger.log(HistoryEntry{Event: "block", Block: config.Secrets.redactPath(config.Path), Dir: config.Dir, Start: start, Exit: exit})
+}
+
+func (logger *ExecLogger) Close() error {
+
+	if logger == nil || logger.file == nil {
+		return nil
+	}
+
+	return logger.file.Close()
+}
+
+/*
+The history builtin: list the blocks that were run, oldest first.  --block
+limits it to a block and its children, --failed to the runs that failed
+and --commands lists the commands of every block as well.
+*/
+func runHistory(dexFile DexFile2, args []string, config ExecConfig) int {
+
+	flags := flag.NewFlagSet("dex history", flag.ContinueOnError)
+	flags.SetOutput(config.Stderr)
+	block := flags.String("block", "", "only show this block and its children, like \"server restart\"")
+	failed := flags.Bool("failed", false, "only show blocks that failed")
+	commands := flags.Bool("commands", false, "show the commands of each block")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if config.Logger == nil || len(config.Logger.Path) == 0 {
+		fmt.Fprintf(config.Stderr, "dex: history is disabled\n")
+		return 1
+	}
+
+	file, err := os.Open(config.Logger.Path)
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+		return 1
+	}
+
+	defer file.Close()
+
+	entries, err := readHistory(file)
+	if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: %s: %v\n", config.Logger.Path, err)
+		return 1
+	}
+
+	prefix := strings.Fields(*block)
+
+	for index, entry := range entries {
+
+		if entry.Event != "block" || !hasPrefix(entry.Block, prefix) || (*failed && entry.Exit == 0) {
+			continue
+		}
+
+		fmt.Fprintf(config.Stdout, "%s  %-20s  %-24s  %-8s  %s\n",
+			entry.Start.Local().Format("2006-01-02 15:04:05"),
+			entry.User+"@"+entry.Host,
+			strings.Join(entry.Block, " "),
+			describeExit(entry.Exit),
+			formatDuration(entry.Duration))
+
+		if !*commands {
+			continue
+		}
+
+		/* Commands are logged before the block they belong to */
+		for _, command := range entries[:index] {
+			if command.Event == "command" && command.Run == entry.Run && slices.Equal(command.Block, entry.Block) &&
+				!command.Start.Before(entry.Start) {
+				fmt.Fprintf(config.Stdout, "    %-8s  %-8s  %s\n", describeExit(command.Exit), formatDuration(command.Duration), command.Command)
+			}
+		}
+	}
+
+	return 0
+}
+
+func readHistory(r io.Reader) ([]HistoryEntry, error) {
+
+	entries := []HistoryEntry{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		var entry HistoryEntry
+
+		/* Skip lines that were cut short */
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func hasPrefix(path, prefix []string) bool {
+	return len(path) >= len(prefix) && slices.Equal(path[:len(prefix)], prefix)
+}
+
+func describeExit(exit int) string {
+
+	if exit == 0 {
+		return "ok"
+	}
+
+	return fmt.Sprintf("exit %d", exit)
+}
+
+func formatDuration(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+}
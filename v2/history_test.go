@@ -0,0 +1,119 @@
+package v2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: server
+    desc: this is a command description
+    children:
+      - name: start
+        desc: this is a command description
+        commands:
+          - exec: echo started
+            dir: /
+      - name: stop
+        desc: this is a command description
+        commands:
+          - exec: exit 3
+  - name: build
+    desc: this is a command description
+    commands:
+      - exec: echo built
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	logFile := filepath.Join(t.TempDir(), "state", "history.jsonl")
+
+	logger, err := newExecLogger(logFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, blockPath := range [][]string{{"server", "start"}, {"server", "stop"}, {"build"}} {
+
+		VarCfgs = map[string]VarCfg{}
+
+		block, err := initBlockFromPath(dexFile, blockPath)
+		if !assert.NoError(t, err, blockPath) {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		processBlock(block, ExecConfig{Stdout: &output, Stderr: &output, Logger: logger, Path: blockPath})
+	}
+
+	logger.Close()
+
+	file, err := os.Open(logFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer file.Close()
+
+	entries, err := readHistory(file)
+	assert.NoError(t, err)
+
+	if assert.Len(t, entries, 6) {
+		assert.Equal(t, "command", entries[0].Event)
+		assert.Equal(t, []string{"server", "start"}, entries[0].Block)
+		assert.Equal(t, "echo started", entries[0].Command)
+		assert.Equal(t, "/", entries[0].Dir)
+		assert.Equal(t, "block", entries[1].Event)
+		assert.Equal(t, 3, entries[3].Exit)
+		assert.Equal(t, entries[0].Run, entries[5].Run)
+		assert.False(t, entries[0].End.Before(entries[0].Start))
+	}
+
+	tests := []struct {
+		Args     []string
+		Expected string
+	}{
+		{
+			Args: []string{},
+			Expected: `^\S+ \S+  \S*@\S*\s+server start\s+ok\s+\S+
+\S+ \S+  \S*@\S*\s+server stop\s+exit 3\s+\S+
+\S+ \S+  \S*@\S*\s+build\s+ok\s+\S+
+$`,
+		},
+		{
+			Args:     []string{"--failed"},
+			Expected: `^\S+ \S+  \S*@\S*\s+server stop\s+exit 3\s+\S+\n$`,
+		},
+		{
+			Args: []string{"--block", "server", "--commands"},
+			Expected: `^\S+ \S+  \S*@\S*\s+server start\s+ok\s+\S+
+    ok\s+\S+\s+echo started
+\S+ \S+  \S*@\S*\s+server stop\s+exit 3\s+\S+
+    exit 3\s+\S+\s+exit 3
+$`,
+		},
+	}
+
+	for _, test := range tests {
+
+		var output bytes.Buffer
+
+		exit := runHistory(dexFile, test.Args, ExecConfig{Stdout: &output, Stderr: &output, Logger: &ExecLogger{Path: logFile}})
+
+		assert.Equal(t, 0, exit, test.Args)
+		assert.Regexp(t, regexp.MustCompile(test.Expected), output.String(), test.Args)
+	}
+}
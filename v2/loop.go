@@ -0,0 +1,321 @@
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+/*
+Loop specification shared by commands and blocks.  Any combination of
+for-vars, for and matrix can be used and produces the cartesian product of
+their iterations.
+
+	for-vars: a list, or the name of a list variable, exposed as var
+	for:      "name in list" where list is a variable or a list literal
+	matrix:   named lists combined into every combination, with optional
+	          exclude and include entries
+*/
+type Loop struct {
+	ForVars any            `yaml:"for-vars"`
+	For     string         `yaml:"for"`
+	Matrix  map[string]any `yaml:"matrix"`
+}
+
+/* Whether any kind of loop is configured */
+func (loop Loop) IsSet() bool {
+	return loop.ForVars != nil || len(loop.For) > 0 || len(loop.Matrix) > 0
+}
+
+/* Capture the loop variable and list expression of for: name in list */
+var forRe = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s+in\s+(.+?)\s*$`)
+
+/*
+Expand the loop into the variables for each iteration.  Every iteration
+has its position in index.  A loop that is not set has a single iteration
+with index 0 and var 1, as commands always had, unless an enclosing loop
+or the DexFile already defines them.
+*/
+func (loop Loop) Iterations(varCfgs map[string]VarCfg) ([]map[string]VarCfg, error) {
+
+	iterations := []map[string]VarCfg{{}}
+
+	if loop.ForVars != nil {
+		list, err := loopList(loop.ForVars, varCfgs)
+		if err != nil {
+			return nil, fmt.Errorf("for-vars: %v", err)
+		}
+
+		iterations = combine(iterations, namedIterations("var", list))
+	}
+
+	if len(loop.For) > 0 {
+		match := forRe.FindStringSubmatch(loop.For)
+		if match == nil {
+			return nil, fmt.Errorf("for: expected \"name in list\" but found %q", loop.For)
+		}
+
+		node, err := parseExpr(render(match[2], varCfgs))
+		if err != nil {
+			return nil, fmt.Errorf("for: %v", err)
+		}
+
+		value, err := node.eval(exprEnv{vars: varCfgs})
+		if err != nil {
+			return nil, fmt.Errorf("for: %v", err)
+		}
+
+		if value.Type != ListVar {
+			return nil, fmt.Errorf("for: %s is not a list", match[2])
+		}
+
+		iterations = combine(iterations, namedIterations(match[1], value.ListValue))
+	}
+
+	if len(loop.Matrix) > 0 {
+		matrix, err := matrixIterations(loop.Matrix, varCfgs)
+		if err != nil {
+			return nil, fmt.Errorf("matrix: %v", err)
+		}
+
+		iterations = combine(iterations, matrix)
+	}
+
+	if !loop.IsSet() {
+		defaults := map[string]VarCfg{
+			"index": {Type: IntVar, IntValue: 0},
+			"var":   {Type: StringVar, StringValue: "1"},
+		}
+
+		for name, value := range defaults {
+			if _, ok := varCfgs[name]; !ok {
+				iterations[0][name] = value
+			}
+		}
+
+		return iterations, nil
+	}
+
+	for index, iteration := range iterations {
+		iteration["index"] = VarCfg{Type: IntVar, IntValue: int64(index)}
+	}
+
+	return iterations, nil
+}
+
+/* Resolve an inline list, or the name of a list variable */
+func loopList(value any, varCfgs map[string]VarCfg) ([]VarCfg, error) {
+
+	if name, ok := value.(string); ok {
+		list, _ := lookupVar(varCfgs, render(name, varCfgs))
+
+		if list.Type != ListVar {
+			return nil, fmt.Errorf("%s is not a list", name)
+		}
+
+		return list.ListValue, nil
+	}
+
+	list, err := newVarCfg(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if list.Type != ListVar {
+		return nil, errors.New("expected a list or the name of a list")
+	}
+
+	return list.ListValue, nil
+}
+
+func namedIterations(name string, list []VarCfg) []map[string]VarCfg {
+
+	iterations := make([]map[string]VarCfg, 0, len(list))
+
+	for _, elem := range list {
+		iterations = append(iterations, map[string]VarCfg{name: elem})
+	}
+
+	return iterations
+}
+
+/* Cartesian product of two sets of iterations, outer varies slowest */
+func combine(outer, inner []map[string]VarCfg) []map[string]VarCfg {
+
+	product := make([]map[string]VarCfg, 0, len(outer)*len(inner))
+
+	for _, outerVars := range outer {
+		for _, innerVars := range inner {
+			iteration := map[string]VarCfg{}
+
+			maps.Copy(iteration, outerVars)
+			maps.Copy(iteration, innerVars)
+
+			product = append(product, iteration)
+		}
+	}
+
+	return product
+}
+
+/*
+Every combination of the matrix lists, ordered by variable name.  Entries
+in exclude remove the combinations they match.  Entries in include add
+their extra variables to the combinations they match, or are added as a
+new combination when they match none.
+*/
+func matrixIterations(matrix map[string]any, varCfgs map[string]VarCfg) ([]map[string]VarCfg, error) {
+
+	names := []string{}
+
+	for name := range matrix {
+		if name != "exclude" && name != "include" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	combinations := []map[string]VarCfg{{}}
+
+	for _, name := range names {
+		list, err := loopList(matrix[name], varCfgs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		combinations = combine(combinations, namedIterations(name, list))
+	}
+
+	if len(names) == 0 {
+		combinations = []map[string]VarCfg{}
+	}
+
+	excludes, err := matrixEntries(matrix["exclude"])
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %v", err)
+	}
+
+	includes, err := matrixEntries(matrix["include"])
+	if err != nil {
+		return nil, fmt.Errorf("include: %v", err)
+	}
+
+	kept := []map[string]VarCfg{}
+
+	for _, combination := range combinations {
+		excluded := false
+
+		for _, exclude := range excludes {
+			if matchesEntry(combination, exclude, names) {
+				excluded = true
+				break
+			}
+		}
+
+		if !excluded {
+			kept = append(kept, combination)
+		}
+	}
+
+	for _, include := range includes {
+		matched := false
+
+		for _, combination := range kept {
+			if matchesEntry(combination, include, names) {
+				for key, value := range include {
+					if !slices.Contains(names, key) {
+						combination[key] = value
+					}
+				}
+
+				matched = true
+			}
+		}
+
+		if !matched {
+			kept = append(kept, maps.Clone(include))
+		}
+	}
+
+	return kept, nil
+}
+
+/*
+A combination matches an entry when every matrix variable in the entry
+has the same value.  Entries without any matrix variables match nothing.
+*/
+func matchesEntry(combination, entry map[string]VarCfg, names []string) bool {
+
+	compared := 0
+
+	for key, value := range entry {
+		if !slices.Contains(names, key) {
+			continue
+		}
+
+		if !valuesEqual(combination[key], value) {
+			return false
+		}
+
+		compared++
+	}
+
+	return compared > 0
+}
+
+/* Decode the list of maps used by exclude and include */
+func matrixEntries(value any) ([]map[string]VarCfg, error) {
+
+	if value == nil {
+		return nil, nil
+	}
+
+	list, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("expected a list of maps")
+	}
+
+	entries := []map[string]VarCfg{}
+
+	for _, elem := range list {
+		entry, err := newVarCfg(elem)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Type != MapVar {
+			return nil, errors.New("expected a list of maps")
+		}
+
+		entries = append(entries, entry.MapValue)
+	}
+
+	return entries, nil
+}
+
+/* Describe the loop variables of an iteration for messages */
+func describeIteration(iteration map[string]VarCfg) string {
+
+	names := []string{}
+
+	for name := range iteration {
+		if name != "index" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	parts := []string{}
+
+	for _, name := range names {
+		parts = append(parts, name+"="+iteration[name].String())
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,193 @@
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Where the output of commands goes.  With a file the output is written to
+it, and with tee to the terminal as well.  Stderr is kept separate unless
+it is merge, when it goes to the file too.  The file name is rendered, so
+loops can keep one file per iteration.
+*/
+type Output struct {
+	File   string
+	Tee    bool
+	Append bool
+	Stderr string
+}
+
+/* Whether output is redirected at all */
+func (output Output) IsSet() bool {
+	return len(output.File) > 0
+}
+
+/*
+Parse the output attribute of a command or block.  Takes a map of the
+output options, or a file name as a shorthand.
+*/
+func parseOutput(value any) (Output, error) {
+
+	output := Output{Stderr: "separate"}
+
+	switch typeVal := value.(type) {
+	case nil:
+		return Output{}, nil
+
+	case string:
+		output.File = typeVal
+
+	case map[string]any:
+		if file, ok := typeVal["file"].(string); ok {
+			output.File = file
+		} else {
+			return Output{}, errors.New("output needs a file")
+		}
+
+		for key, field := range map[string]*bool{"tee": &output.Tee, "append": &output.Append} {
+			switch flag := typeVal[key].(type) {
+			case nil:
+			case bool:
+				*field = flag
+			default:
+				return Output{}, fmt.Errorf("invalid output %s %v, expected true or false", key, flag)
+			}
+		}
+
+		if stderr, ok := typeVal["stderr"]; ok {
+			output.Stderr = fmt.Sprint(stderr)
+
+			if output.Stderr != "merge" && output.Stderr != "separate" {
+				return Output{}, fmt.Errorf("invalid output stderr %q, expected merge or separate", output.Stderr)
+			}
+		}
+
+	default:
+		return Output{}, fmt.Errorf("invalid output %v", value)
+	}
+
+	return output, nil
+}
+
+/*
+The files opened for output while a block runs.  A file is truncated the
+first time it is opened, unless it is appended to, and later commands and
+iterations writing to it add to it.  Nothing is opened for a dry run,
+which discards the output instead of emptying the files.
+*/
+type outputFiles struct {
+	mutex   sync.Mutex
+	files   map[string]*os.File
+	discard bool
+}
+
+func (outputs *outputFiles) open(path string, appendTo bool) (*os.File, error) {
+
+	outputs.mutex.Lock()
+	defer outputs.mutex.Unlock()
+
+	if file, ok := outputs.files[path]; ok {
+		return file, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendTo {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if outputs.files == nil {
+		outputs.files = map[string]*os.File{}
+	}
+
+	outputs.files[path] = file
+
+	return file, nil
+}
+
+func (outputs *outputFiles) close() {
+
+	outputs.mutex.Lock()
+	defer outputs.mutex.Unlock()
+
+	for path, file := range outputs.files {
+		file.Close()
+		delete(outputs.files, path)
+	}
+}
+
+/* Point the writers of config at the output file */
+func (output Output) apply(varCfgs map[string]VarCfg, config ExecConfig) (ExecConfig, error) {
+
+	if !output.IsSet() {
+		return config, nil
+	}
+
+	if config.Outputs == nil {
+		return config, errors.New("output files are not available")
+	}
+
+	path := render(output.File, varCfgs)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(config.Dir, path)
+	}
+
+	stdout := io.Discard
+
+	if !config.Outputs.discard {
+		file, err := config.Outputs.open(path, output.Append)
+		if err != nil {
+			return config, err
+		}
+
+		stdout = file
+	}
+
+	/* Both streams are copied at the same time and can share a writer */
+	if output.Tee && config.Stdout != nil {
+		mutex := &sync.Mutex{}
+
+		stdout = io.MultiWriter(stdout, lockedWriter{mutex, config.Stdout})
+
+		if config.Stderr != nil {
+			config.Stderr = lockedWriter{mutex, config.Stderr}
+		}
+	}
+
+	/* The same writer for both, so writes of the two never interleave */
+	if output.Stderr == "merge" {
+		config.Stderr = stdout
+	}
+
+	config.Stdout = stdout
+	config.OutputFile = true
+
+	return config, nil
+}
+
+/* A writer that takes the mutex for every write */
+type lockedWriter struct {
+	mutex *sync.Mutex
+	w     io.Writer
+}
+
+func (writer lockedWriter) Write(data []byte) (int, error) {
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	return writer.w.Write(data)
+}
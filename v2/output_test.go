@@ -0,0 +1,255 @@
+package v2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutput(t *testing.T) {
+
+	tests := []struct {
+		DexTest
+		Files map[string]string
+	}{
+		{
+			DexTest: DexTest{
+				Name: "file per iteration",
+				Config: `---
+version: 2
+blocks:
+  - name: output
+    desc: this is a command description
+    commands:
+      - exec: echo deploy [% var %]; echo oops >&2
+        for-vars: [web1, web2]
+        output: logs/[% var %].log
+      - exec: echo again [% var %]
+        for-vars: [web1]
+        output:
+          file: logs/[% var %].log
+          tee: true
+`,
+				BlockPath:  []string{"output"},
+				CommandOut: "oops\noops\nagain web1\n",
+			},
+			Files: map[string]string{
+				"logs/web1.log": "deploy web1\nagain web1\n",
+				"logs/web2.log": "deploy web2\n",
+			},
+		},
+		{
+			DexTest: DexTest{
+				Name: "merged stderr and append",
+				Config: `---
+version: 2
+blocks:
+  - name: output
+    desc: this is a command description
+    commands:
+      - exec: echo out; echo err >&2
+        output:
+          file: merged.log
+          stderr: merge
+          append: true
+      - diag: done
+`,
+				BlockPath:  []string{"output"},
+				CommandOut: "done\n",
+			},
+			Files: map[string]string{
+				"merged.log": "previous\nout\nerr\n",
+			},
+		},
+		{
+			DexTest: DexTest{
+				Name: "block output",
+				Config: `---
+version: 2
+blocks:
+  - name: output
+    desc: this is a command description
+    for: host in ["db1", "db2"]
+    output:
+      file: "[% host %]/backup.log"
+      tee: true
+    commands:
+      - diag: backing up [% host %]
+      - exec: echo dumped
+      - exec: echo elsewhere
+        output: other.log
+`,
+				BlockPath:  []string{"output"},
+				CommandOut: "backing up db1\ndumped\nbacking up db2\ndumped\n",
+			},
+			Files: map[string]string{
+				"db1/backup.log": "backing up db1\ndumped\n",
+				"db2/backup.log": "backing up db2\ndumped\n",
+				"other.log":      "elsewhere\nelsewhere\n",
+			},
+		},
+		{
+			DexTest: DexTest{
+				Name: "session",
+				Config: `---
+version: 2
+blocks:
+  - name: output
+    desc: this is a command description
+    session: true
+    commands:
+      - exec: echo out; sleep 0.1; echo err >&2
+        output:
+          file: session.log
+          stderr: merge
+      - exec: echo next; sleep 0.1; echo oops >&2
+      - exec: exec 2>/dev/null; echo hidden >&2
+      - exec: echo last
+`,
+				BlockPath:  []string{"output"},
+				CommandOut: "next\noops\nlast\n",
+			},
+			Files: map[string]string{
+				"session.log": "out\nerr\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "merged.log"), []byte("previous\n"), 0644)
+
+		block, tDexFile, err := setupTestBlock(t, test.DexTest)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+			Dir:    dir,
+		}
+
+		processBlock(block, config)
+
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+
+		for name, expected := range test.Files {
+			content, err := os.ReadFile(filepath.Join(dir, name))
+
+			assert.NoError(t, err, test.Name)
+			assert.Equal(t, expected, string(content), test.Name+" "+name)
+		}
+	}
+}
+
+func TestOutputDiags(t *testing.T) {
+
+	/* A character device that is not /dev/null passes for a terminal */
+	terminal, err := os.OpenFile("/dev/zero", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no /dev/zero")
+	}
+
+	defer terminal.Close()
+
+	dir := t.TempDir()
+
+	block, tDexFile, err := setupTestBlock(t, DexTest{
+		Config: `---
+version: 2
+blocks:
+  - name: output
+    desc: this is a command description
+    output: build.log
+    commands:
+      - diag: building
+      - exec: echo built
+`,
+		BlockPath: []string{"output"},
+	})
+
+	defer os.Remove(tDexFile.Name())
+
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var output bytes.Buffer
+
+	processBlock(block, ExecConfig{Stdout: &output, Stderr: terminal, Dir: dir})
+
+	content, err := os.ReadFile(filepath.Join(dir, "build.log"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "building\nbuilt\n", string(content))
+	assert.Empty(t, output.String())
+}
+
+/* A dry run leaves the output files as they are, also of blocks it runs */
+func TestOutputDryRun(t *testing.T) {
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "build.log"), []byte("last build\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "test.log"), []byte("last test\n"), 0644)
+
+	dexFile, err := ParseConfig([]byte(`---
+version: 2
+blocks:
+  - name: build
+    desc: this is a command description
+    output: build.log
+    container: alpine
+    commands:
+      - exec: make
+      - run: test
+  - name: test
+    desc: this is a command description
+    output:
+      file: test.log
+      tee: true
+    commands:
+      - exec: make test
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	VarCfgs = map[string]VarCfg{}
+
+	block, err := initBlockFromPath(dexFile, []string{"build"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var output bytes.Buffer
+
+	exit := processBlock(block, ExecConfig{
+		Stdout:   &output,
+		Stderr:   &output,
+		Dir:      dir,
+		File:     &dexFile,
+		Calls:    []string{"build"},
+		Path:     []string{"build"},
+		Executor: &RecordingExecutor{Output: &output},
+	})
+
+	assert.Equal(t, 0, exit, output.String())
+	assert.Contains(t, output.String(), "dex: would run docker run ")
+
+	for name, expected := range map[string]string{"build.log": "last build\n", "test.log": "last test\n"} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content), name)
+	}
+}
@@ -0,0 +1,174 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+The host commands run on, with the ssh command line.  Commands run in
+their dir on the host when it is set, and the fields are rendered, so
+loops can go over hosts.
+*/
+type Remote struct {
+	Host     string
+	User     string
+	Port     string
+	Identity string
+}
+
+/* Whether commands run on a remote host at all */
+func (remote Remote) IsSet() bool {
+	return len(remote.Host) > 0
+}
+
+/*
+Parse the remote attribute of a command or block.  Takes a map of the
+remote options, or a host as a shorthand.
+*/
+func parseRemote(value any) (Remote, error) {
+
+	remote := Remote{}
+
+	switch typeVal := value.(type) {
+	case nil:
+		return remote, nil
+
+	case string:
+		remote.Host = typeVal
+
+	case map[string]any:
+		if host, ok := typeVal["host"].(string); ok {
+			remote.Host = host
+		} else {
+			return Remote{}, errors.New("remote needs a host")
+		}
+
+		assignIfSet(typeVal, "user", &remote.User)
+		assignIfSet(typeVal, "port", &remote.Port)
+		assignIfSet(typeVal, "identity", &remote.Identity)
+
+	default:
+		return Remote{}, fmt.Errorf("invalid remote %v", value)
+	}
+
+	return remote, nil
+}
+
+/*
+An executor running commands on the host, rendered with the variables,
+through inner.  Commands in localDir, the base directory of the run where
+they run unless they have a dir, run in the home directory on the host.
+*/
+func (remote Remote) executor(varCfgs map[string]VarCfg, localDir string, inner Executor) Executor {
+
+	return &RemoteExecutor{
+		Remote: Remote{
+			Host:     render(remote.Host, varCfgs),
+			User:     render(remote.User, varCfgs),
+			Port:     render(remote.Port, varCfgs),
+			Identity: render(remote.Identity, varCfgs),
+		},
+		LocalDir: localDir,
+		Inner:    inner,
+	}
+}
+
+/*
+Runs commands on a remote host with ssh.  The command, its directory and
+environment are quoted into the one command line ssh takes, and the files
+it reads are written on the host first.  The exit code of the command is
+the exit code of ssh, which is 255 when ssh itself fails.  ssh is run by
+Inner, a LocalExecutor when nil.
+*/
+type RemoteExecutor struct {
+	Remote   Remote
+	LocalDir string
+	Inner    Executor
+}
+
+func (executor *RemoteExecutor) Run(ctx context.Context, spec ExecSpec) ExecResult {
+
+	inner := executor.Inner
+	if inner == nil {
+		inner = LocalExecutor{}
+	}
+
+	args := []string{}
+
+	if len(executor.Remote.Port) > 0 {
+		args = append(args, "-p", executor.Remote.Port)
+	}
+
+	if len(executor.Remote.Identity) > 0 {
+		args = append(args, "-i", executor.Remote.Identity)
+	}
+
+	if len(executor.Remote.User) > 0 {
+		args = append(args, "-l", executor.Remote.User)
+	}
+
+	command, err := executor.command(spec)
+	if err != nil {
+		fmt.Fprintf(spec.Stderr, "dex: %v\n", err)
+		return ExecResult{Exit: 1}
+	}
+
+	args = append(args, "--", executor.Remote.Host, command)
+
+	return inner.Run(ctx, ExecSpec{
+		Cmd:         "ssh",
+		Args:        args,
+		Stdin:       spec.Stdin,
+		Stdout:      spec.Stdout,
+		Stderr:      spec.Stderr,
+		GracePeriod: spec.GracePeriod,
+		Foreground:  spec.Foreground,
+		Redact:      spec.Redact,
+	})
+}
+
+/* The command line for the shell on the host */
+func (executor *RemoteExecutor) command(spec ExecSpec) (string, error) {
+
+	command := ExecSpec{Cmd: spec.Cmd, Args: spec.Args}.String()
+
+	if len(spec.Env) > 0 {
+		command = ExecSpec{Cmd: "env", Args: spec.Env}.String() + " " + command
+	}
+
+	if len(spec.Dir) > 0 && spec.Dir != executor.LocalDir {
+		command = "cd -- " + shellQuote(spec.Dir) + " && " + command
+	}
+
+	if len(spec.Files) == 0 {
+		return command, nil
+	}
+
+	/* Files are written to the same paths and removed when the command is done */
+	setup := []string{}
+	paths := []string{}
+
+	for _, file := range spec.Files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		path := shellQuote(file)
+
+		setup = append(setup,
+			"mkdir -p -- "+shellQuote(filepath.Dir(file)),
+			"printf '%s' "+shellQuote(string(content))+" > "+path,
+			"chmod 700 "+path)
+
+		paths = append(paths, path)
+	}
+
+	return fmt.Sprintf("%s && (%s); status=$?; rm -f -- %s; exit $status",
+		strings.Join(setup, " && "), command, strings.Join(paths, " ")), nil
+}
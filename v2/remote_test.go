@@ -0,0 +1,216 @@
+package v2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* Logs its arguments, then runs the command for the host on this machine */
+const stubSSH = `#!/bin/sh
+for arg in "$@"; do printf '[%s]' "$arg"; done >> "$DEX_SSH_LOG"
+echo >> "$DEX_SSH_LOG"
+while [ "$1" != -- ]; do shift; done
+[ "$2" = unreachable ] && exit 255
+exec sh -c "$3"
+`
+
+func TestParseRemote(t *testing.T) {
+
+	tests := []struct {
+		Value    any
+		Expected Remote
+		Error    string
+	}{
+		{
+			Value:    "deploy@web1",
+			Expected: Remote{Host: "deploy@web1"},
+		},
+		{
+			Value: map[string]any{
+				"host":     "web1.example.com",
+				"user":     "deploy",
+				"port":     uint64(2222),
+				"identity": "~/.ssh/deploy",
+			},
+			Expected: Remote{Host: "web1.example.com", User: "deploy", Port: "2222", Identity: "~/.ssh/deploy"},
+		},
+		{
+			Value: map[string]any{"user": "deploy"},
+			Error: "remote needs a host",
+		},
+	}
+
+	for _, test := range tests {
+
+		remote, err := parseRemote(test.Value)
+
+		if len(test.Error) > 0 {
+			assert.EqualError(t, err, test.Error)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, test.Expected, remote)
+	}
+}
+
+func TestRemote(t *testing.T) {
+
+	stubs := t.TempDir()
+	os.WriteFile(filepath.Join(stubs, "ssh"), []byte(stubSSH), 0755)
+
+	t.Setenv("PATH", stubs+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		DexTest
+		Exit     int
+		Log      string
+		Contains []string
+	}{
+		{
+			DexTest: DexTest{
+				Name: "block remote",
+				Config: `---
+version: 2
+blocks:
+  - name: deploy
+    desc: this is a command description
+    dir: /
+    remote:
+      host: web1
+      user: deploy
+      port: 2222
+      identity: /keys/deploy
+    commands:
+      - exec: printf '%s\n' "it's $GREETING in $PWD"; exit 3
+`,
+				BlockPath:  []string{"deploy"},
+				CommandOut: "it's hello in /\n",
+			},
+			Exit: 3,
+			Log: `[-p][2222][-i][/keys/deploy][-l][deploy][--][web1]` +
+				`[cd -- '/' && env GREETING=hello /bin/bash -c 'printf '\''%s\n'\'' "it'\''s $GREETING in $PWD"; exit 3']
+`,
+		},
+		{
+			DexTest: DexTest{
+				Name: "command remotes",
+				Config: `---
+version: 2
+blocks:
+  - name: deploy
+    desc: this is a command description
+    commands:
+      - exec: echo on [% var %]
+        for-vars: [web1, web2]
+        remote: "[% var %]"
+        condition-shell: -d /
+      - script: |
+          echo from a script
+        remote:
+          host: web3
+          port: 22
+`,
+				BlockPath:  []string{"deploy"},
+				CommandOut: "on web1\non web2\nfrom a script\n",
+			},
+			Log: `[--][web1][env GREETING=hello /bin/bash -c 'test -d /']
+[--][web1][env GREETING=hello /bin/bash -c 'echo on web1']
+[--][web2][env GREETING=hello /bin/bash -c 'test -d /']
+[--][web2][env GREETING=hello /bin/bash -c 'echo on web2']
+`,
+			/* Scripts are written on the host and removed again */
+			Contains: []string{"[-p][22][--][web3][mkdir -p -- ", `printf '%s' 'echo from a script`, "; status=$?; rm -f -- "},
+		},
+		{
+			DexTest: DexTest{
+				Name: "unreachable",
+				Config: `---
+version: 2
+blocks:
+  - name: deploy
+    desc: this is a command description
+    remote: unreachable
+    commands:
+      - exec: echo never
+`,
+				BlockPath: []string{"deploy"},
+			},
+			Exit: 255,
+			Log: `[--][unreachable][env GREETING=hello /bin/bash -c 'echo never']
+`,
+		},
+	}
+
+	for _, test := range tests {
+
+		logFile := filepath.Join(t.TempDir(), "ssh.log")
+		t.Setenv("DEX_SSH_LOG", logFile)
+
+		block, tDexFile, err := setupTestBlock(t, test.DexTest)
+
+		defer os.Remove(tDexFile.Name())
+
+		if !assert.NoError(t, err, test.Name) {
+			continue
+		}
+
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+
+		exit := processBlock(block, ExecConfig{Stdout: &stdout, Stderr: &stderr, Env: []string{"GREETING=hello"}})
+
+		log, _ := os.ReadFile(logFile)
+
+		assert.Equal(t, test.Exit, exit, test.Name)
+		assert.Equal(t, test.CommandOut, stdout.String(), test.Name)
+		assert.True(t, bytes.HasPrefix(log, []byte(test.Log)), "%s: %s", test.Name, log)
+
+		for _, expected := range test.Contains {
+			assert.Contains(t, string(log), expected, test.Name)
+		}
+	}
+}
+
+/* Commands in the directory the run started in run in the home directory on the host */
+func TestRemoteBaseDir(t *testing.T) {
+
+	dexFile, err := ParseConfig([]byte(`---
+version: 2
+blocks:
+  - name: deploy
+    desc: this is a command description
+    remote: web1
+    commands:
+      - exec: uptime
+      - exec: ls
+        dir: /var/www
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	block, err := initBlockWithVars(dexFile, []string{"deploy"}, map[string]VarCfg{}, nil, ExecConfig{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	recorder := &RecordingExecutor{}
+
+	var output bytes.Buffer
+
+	exit := processBlock(block, ExecConfig{Stdout: &output, Stderr: &output, Dir: t.TempDir(), Executor: recorder})
+
+	assert.Equal(t, 0, exit)
+
+	commands := []string{}
+	for _, spec := range recorder.Specs() {
+		commands = append(commands, spec.Args[len(spec.Args)-1])
+	}
+
+	assert.Equal(t, []string{"/bin/bash -c uptime", "cd -- '/var/www' && /bin/bash -c ls"}, commands)
+}
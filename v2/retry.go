@@ -0,0 +1,206 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+/*
+How a failing command is retried.  Attempts counts the first run, so
+attempts: 3 retries a command twice.  The zero Retry runs a command once.  With exponential backoff the delay
+doubles after every attempt, up to max-delay when it is set.  When
+on-exit-codes is set only those exit codes are retried.
+*/
+type Retry struct {
+	Attempts    int
+	Delay       time.Duration
+	MaxDelay    time.Duration
+	Backoff     string
+	OnExitCodes []int
+}
+
+/* Delay before the first retry when none is configured */
+var DefaultRetryDelay = time.Second
+
+/*
+Parse the retry attribute of a command or variable.  Takes a map of the
+retry options, or a number as a shorthand for the attempts.
+*/
+func parseRetry(value any) (Retry, error) {
+
+	retry := Retry{Attempts: 1}
+
+	switch typeVal := value.(type) {
+	case nil:
+		return Retry{}, nil
+
+	case uint64:
+		retry.Attempts = int(typeVal)
+		retry.Delay = DefaultRetryDelay
+
+	case map[string]any:
+		retry.Delay = DefaultRetryDelay
+
+		if attempts, ok := typeVal["attempts"]; ok {
+			count, err := strconv.Atoi(fmt.Sprint(attempts))
+			if err != nil {
+				return Retry{}, fmt.Errorf("invalid retry attempts %v", attempts)
+			}
+
+			retry.Attempts = count
+		}
+
+		for key, field := range map[string]*time.Duration{"delay": &retry.Delay, "max-delay": &retry.MaxDelay} {
+			if delay, ok := typeVal[key]; ok {
+				duration, err := parseTimeout(fmt.Sprint(delay))
+				if err != nil {
+					return Retry{}, fmt.Errorf("invalid retry %s %v", key, delay)
+				}
+
+				*field = duration
+			}
+		}
+
+		if backoff, ok := typeVal["backoff"]; ok {
+			retry.Backoff = fmt.Sprint(backoff)
+
+			if retry.Backoff != "constant" && retry.Backoff != "exponential" {
+				return Retry{}, fmt.Errorf("invalid retry backoff %q, expected constant or exponential", retry.Backoff)
+			}
+		}
+
+		if codes, ok := typeVal["on-exit-codes"]; ok {
+			list, ok := codes.([]any)
+			if !ok {
+				return Retry{}, errors.New("retry on-exit-codes must be a list")
+			}
+
+			for _, code := range list {
+				exitCode, err := strconv.Atoi(fmt.Sprint(code))
+				if err != nil {
+					return Retry{}, fmt.Errorf("invalid retry exit code %v", code)
+				}
+
+				retry.OnExitCodes = append(retry.OnExitCodes, exitCode)
+			}
+		}
+
+	default:
+		return Retry{}, fmt.Errorf("invalid retry %v", value)
+	}
+
+	if retry.Attempts < 1 {
+		return Retry{}, fmt.Errorf("retry attempts must be at least 1")
+	}
+
+	return retry, nil
+}
+
+/* Whether a command that exited with the code should be run again */
+func (retry Retry) shouldRetry(exit int) bool {
+	return exit != 0 && (len(retry.OnExitCodes) == 0 || slices.Contains(retry.OnExitCodes, exit))
+}
+
+/* Delay after the numbered attempt failed, starting from 1 */
+func (retry Retry) delayAfter(attempt int) time.Duration {
+
+	delay := retry.Delay
+
+	if retry.Backoff == "exponential" {
+		for i := 1; i < attempt; i++ {
+			delay *= 2
+
+			if retry.MaxDelay > 0 && delay >= retry.MaxDelay {
+				break
+			}
+		}
+	}
+
+	if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+		delay = retry.MaxDelay
+	}
+
+	return delay
+}
+
+/*
+Run a command, running it again while it fails and attempts remain.  Each
+failed attempt and the final outcome of a retried command are logged.  A
+timeout of the command itself counts as a failure with ExitTimeout, while
+a timeout or interrupt of the whole run stops retrying.  reset, when not
+nil, is called before every attempt, so output captured for a variable
+only keeps the last attempt.
+*/
+func execWithRetry(config ExecConfig, retry Retry, label string, reset func()) (int, error) {
+
+	log := config.Stderr
+	if log == nil {
+		log = os.Stderr
+	}
+
+	attempts := max(retry.Attempts, 1)
+
+	for attempt := 1; ; attempt++ {
+
+		if reset != nil {
+			reset()
+		}
+
+		/* Every attempt reads stdin from the start */
+		if seeker, ok := config.Stdin.(io.Seeker); ok {
+			seeker.Seek(0, io.SeekStart)
+		}
+
+		exit, err := execCommand(config)
+
+		if cancelled := cancelExitCodeFor(execContext(config)); cancelled != 0 {
+			return cancelled, err
+		}
+
+		/* An interrupt from the terminal can arrive before the run is cancelled */
+		var interruptErr *InterruptError
+		if errors.As(err, &interruptErr) {
+			return exit, err
+		}
+
+		if !retry.shouldRetry(exit) || attempt >= attempts {
+			if attempt > 1 {
+				logRetryOutcome(log, exit, attempt, label)
+			}
+
+			return exit, err
+		}
+
+		delay := retry.delayAfter(attempt)
+
+		reason := fmt.Sprintf("exit code %d", exit)
+		if err != nil {
+			reason = err.Error()
+		}
+
+		fmt.Fprintf(log, "dex: attempt %d of %d failed with %s, retrying in %v: %s\n", attempt, attempts, reason, delay, label)
+
+		ctx := execContext(config)
+
+		select {
+		case <-ctx.Done():
+			return cancelExitCodeFor(ctx), context.Cause(ctx)
+		case <-time.After(delay):
+		}
+	}
+}
+
+func logRetryOutcome(w io.Writer, exit, attempt int, label string) {
+
+	if exit == 0 {
+		fmt.Fprintf(w, "dex: succeeded on attempt %d: %s\n", attempt, label)
+	} else {
+		fmt.Fprintf(w, "dex: failed with exit code %d after %d attempts: %s\n", exit, attempt, label)
+	}
+}
@@ -0,0 +1,173 @@
+package v2
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetry(t *testing.T) {
+
+	tests := []struct {
+		Name     string
+		Value    any
+		Expected Retry
+		Error    string
+	}{
+		{Name: "unset", Value: nil, Expected: Retry{}},
+		{Name: "shorthand", Value: uint64(3), Expected: Retry{Attempts: 3, Delay: time.Second}},
+		{
+			Name: "all options",
+			Value: map[string]any{
+				"attempts":      uint64(4),
+				"delay":         "2s",
+				"max-delay":     uint64(5),
+				"backoff":       "exponential",
+				"on-exit-codes": []any{uint64(1), uint64(75)},
+			},
+			Expected: Retry{Attempts: 4, Delay: 2 * time.Second, MaxDelay: 5 * time.Second, Backoff: "exponential", OnExitCodes: []int{1, 75}},
+		},
+		{Name: "bad backoff", Value: map[string]any{"backoff": "linear"}, Error: `invalid retry backoff "linear", expected constant or exponential`},
+		{Name: "bad attempts", Value: map[string]any{"attempts": uint64(0)}, Error: "retry attempts must be at least 1"},
+		{Name: "bad codes", Value: map[string]any{"on-exit-codes": "1"}, Error: "retry on-exit-codes must be a list"},
+		{Name: "bad type", Value: "always", Error: "invalid retry always"},
+	}
+
+	for _, test := range tests {
+		retry, err := parseRetry(test.Value)
+
+		if len(test.Error) > 0 {
+			assert.EqualError(t, err, test.Error, test.Name)
+			continue
+		}
+
+		assert.NoError(t, err, test.Name)
+		assert.Equal(t, test.Expected, retry, test.Name)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+
+	constant := Retry{Attempts: 5, Delay: time.Second}
+	exponential := Retry{Attempts: 5, Delay: time.Second, Backoff: "exponential", MaxDelay: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+
+	for attempt := 1; attempt <= 4; attempt++ {
+		assert.Equal(t, time.Second, constant.delayAfter(attempt))
+		assert.Equal(t, expected[attempt-1], exponential.delayAfter(attempt))
+	}
+
+	assert.True(t, Retry{}.shouldRetry(1))
+	assert.False(t, Retry{}.shouldRetry(0))
+	assert.True(t, Retry{OnExitCodes: []int{75}}.shouldRetry(75))
+	assert.False(t, Retry{OnExitCodes: []int{75}}.shouldRetry(1))
+}
+
+func TestRetryCommands(t *testing.T) {
+
+	/* Fails until it has been run the given number of times */
+	flaky := `n=$(cat [%% var %%] 2>/dev/null || echo 0); n=$((n+1)); echo $n > [%% var %%]; [ $n -ge %d ]`
+
+	tests := []DexTest{
+		{
+			Name: "succeeds after retries",
+			Config: fmt.Sprintf(`---
+version: 2
+blocks:
+  - name: retry
+    desc: this is a command description
+    dir: %s
+    commands:
+      - exec: '%s'
+        for-vars: [first]
+        retry:
+          attempts: 3
+          delay: 10ms
+          backoff: exponential
+      - exec: echo done
+`, t.TempDir(), fmt.Sprintf(flaky, 3)),
+			BlockPath: []string{"retry"},
+			CommandOut: `dex: attempt 1 of 3 failed with exit code 1, retrying in 10ms: ` + fmt.Sprintf(flakyRendered, "first", "first", 3) + `
+dex: attempt 2 of 3 failed with exit code 1, retrying in 20ms: ` + fmt.Sprintf(flakyRendered, "first", "first", 3) + `
+dex: succeeded on attempt 3: ` + fmt.Sprintf(flakyRendered, "first", "first", 3) + `
+done
+`,
+		},
+		{
+			Name: "gives up",
+			Config: `---
+version: 2
+blocks:
+  - name: retry
+    desc: this is a command description
+    commands:
+      - exec: exit 2
+        retry:
+          attempts: 2
+          delay: 0
+      - exec: exit 3
+        retry:
+          attempts: 2
+          on-exit-codes: [2]
+`,
+			BlockPath: []string{"retry"},
+			CommandOut: `dex: attempt 1 of 2 failed with exit code 2, retrying in 0s: exit 2
+dex: failed with exit code 2 after 2 attempts: exit 2
+`,
+		},
+	}
+
+	for _, test := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+		}
+
+		processBlock(block, config)
+
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+	}
+}
+
+const flakyRendered = `n=$(cat %s 2>/dev/null || echo 0); n=$((n+1)); echo $n > %s; [ $n -ge %d ]`
+
+func TestRetryFromCommand(t *testing.T) {
+
+	dir := t.TempDir()
+
+	VarCfgs = map[string]VarCfg{}
+
+	initVars(map[string]any{
+		"flaky": map[string]any{
+			"from-command": fmt.Sprintf(`cd %s; n=$(cat count 2>/dev/null || echo 0); n=$((n+1)); echo $n > count; [ $n -ge 2 ] && echo ready`, dir),
+			"retry":        map[string]any{"attempts": uint64(2), "delay": "0"},
+		},
+		"noisy": map[string]any{
+			"from-command": fmt.Sprintf(`cd %s; n=$(cat noisy 2>/dev/null || echo 0); n=$((n+1)); echo $n > noisy; echo attempt$n; [ $n -ge 2 ]`, dir),
+			"retry":        map[string]any{"attempts": uint64(2), "delay": "0"},
+		},
+	})
+
+	assert.Equal(t, "ready", VarCfgs["flaky"].StringValue)
+
+	/* The output of the failed attempt is dropped, not made into a list */
+	assert.Equal(t, StringVar, VarCfgs["noisy"].Type)
+	assert.Equal(t, "attempt2", VarCfgs["noisy"].StringValue)
+	assert.Equal(t, 2, VarCfgs["flaky"].Retry.Attempts)
+}
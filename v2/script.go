@@ -0,0 +1,73 @@
+package v2
+
+import (
+	"os"
+	"strings"
+)
+
+/*
+Write the script of a command to a temporary file and set up config to run
+it: with the interpreter when one is set, directly when the script starts
+with #!, or with the shell of the command otherwise.  The returned function
+removes the file once the script has run.
+*/
+func prepareScript(command Command, script string, varCfgs map[string]VarCfg, config *ExecConfig) (func(), error) {
+
+	file, err := os.CreateTemp("", "dex-script-*")
+	if err != nil {
+		return nil, err
+	}
+
+	remove := func() { os.Remove(file.Name()) }
+
+	if _, err := file.WriteString(script); err != nil {
+		file.Close()
+		remove()
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		remove()
+		return nil, err
+	}
+
+	/* Executable for the kernel to use the #! line */
+	if err := os.Chmod(file.Name(), 0700); err != nil {
+		remove()
+		return nil, err
+	}
+
+	config.Files = append(config.Files, file.Name())
+
+	interpreter := strings.Fields(render(command.Interpreter, varCfgs))
+
+	switch {
+	case len(interpreter) > 0:
+		config.Cmd = interpreter[0]
+		config.Args = append(interpreter[1:], file.Name())
+
+	case strings.HasPrefix(script, "#!"):
+		config.Cmd = file.Name()
+		config.Args = nil
+
+	default:
+		config.Cmd = command.Shell
+		config.Args = []string{file.Name()}
+	}
+
+	return remove, nil
+}
+
+/* The first line of a script that is not its #! line, for messages */
+func scriptLabel(script string) string {
+
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+
+		if len(line) > 0 && !strings.HasPrefix(line, "#!") {
+			return "script: " + line
+		}
+	}
+
+	return "script"
+}
@@ -0,0 +1,101 @@
+package v2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScripts(t *testing.T) {
+
+	tests := []DexTest{
+		{
+			Name: "script with the shell",
+			Config: `---
+version: 2
+vars:
+  name: world
+blocks:
+  - name: script
+    desc: this is a command description
+    commands:
+      - script: |
+          greeting="hello"
+          echo "$greeting [% name %]"
+          echo "it's quoted"
+`,
+			BlockPath:  []string{"script"},
+			CommandOut: "hello world\nit's quoted\n",
+		},
+		{
+			Name: "shebang and interpreter",
+			Config: `---
+version: 2
+blocks:
+  - name: script
+    desc: this is a command description
+    commands:
+      - script: |
+          #!/bin/sh
+          echo "from $0" | sed 's/from .*dex-script-.*/from sh/'
+      - script: |
+          set -- one two
+          echo "$# args"
+        interpreter: sh -e
+      - script: exit 3
+`,
+			BlockPath:  []string{"script"},
+			CommandOut: "from sh\n2 args\n",
+		},
+		{
+			Name: "stdin",
+			Config: `---
+version: 2
+vars:
+  hosts: [web1, web2]
+blocks:
+  - name: script
+    desc: this is a command description
+    commands:
+      - exec: cat
+        stdin: |
+          hello [% hosts.0 %]
+      - exec: tr a-z A-Z
+        stdin: "[% hosts %]"
+        register: upper
+      - script: read line; echo "$line"
+        stdin: "[% upper %]"
+`,
+			BlockPath:  []string{"script"},
+			CommandOut: "hello web1\nWEB1 WEB2\n",
+		},
+	}
+
+	for _, test := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+		}
+
+		processBlock(block, config)
+
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+	}
+
+	scripts, _ := filepath.Glob(filepath.Join(os.TempDir(), "dex-script-*"))
+	assert.Empty(t, scripts, "scripts are removed")
+}
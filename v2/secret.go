@@ -0,0 +1,129 @@
+package v2
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/* What secret values are replaced with */
+const redacted = "****"
+
+/* Shorter secrets are not redacted, as they would hide too much else */
+const minSecretLength = 4
+
+/*
+Values of the secret variables of a run, redacted from everything dex
+writes itself: messages, logs, history and timings.  They are kept by
+value so that anything rendered from a secret is redacted too.  A nil
+*secretValues redacts nothing.
+*/
+type secretValues struct {
+	mutex    sync.Mutex
+	values   []string
+	replacer *strings.Replacer
+}
+
+/*
+Remember the values of a secret variable, the elements of lists and maps
+too.  Values too short to redact are warned about on stderr.
+*/
+func (secrets *secretValues) add(name string, varCfg VarCfg, stderr io.Writer) {
+
+	if secrets == nil {
+		return
+	}
+
+	values := []string{varCfg.String()}
+
+	for _, elem := range varCfg.ListValue {
+		values = append(values, elem.String())
+	}
+
+	for _, elem := range varCfg.MapValue {
+		values = append(values, elem.String())
+	}
+
+	secrets.mutex.Lock()
+	defer secrets.mutex.Unlock()
+
+	short := false
+
+	for _, value := range values {
+		if len(value) > 0 && len(value) < minSecretLength {
+			short = true
+		} else if len(value) > 0 && !slices.Contains(secrets.values, value) {
+			secrets.values = append(secrets.values, value)
+		}
+	}
+
+	if short {
+		fmt.Fprintf(stderr, "dex: warning: secret %s is too short to redact\n", name)
+	}
+
+	/* Longer values first, so a secret containing another is redacted whole */
+	slices.SortFunc(secrets.values, func(a, b string) int { return len(b) - len(a) })
+
+	pairs := []string{}
+	for _, value := range secrets.values {
+		pairs = append(pairs, value, redacted)
+	}
+
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+/* Replace the values of secret variables in text */
+func (secrets *secretValues) redact(text string) string {
+
+	if secrets == nil {
+		return text
+	}
+
+	secrets.mutex.Lock()
+	replacer := secrets.replacer
+	secrets.mutex.Unlock()
+
+	if replacer == nil {
+		return text
+	}
+
+	return replacer.Replace(text)
+}
+
+/* Redact the names of a block path, for blocks run with a secret name */
+func (secrets *secretValues) redactPath(path []string) []string {
+
+	redactedPath := make([]string, 0, len(path))
+
+	for _, name := range path {
+		redactedPath = append(redactedPath, secrets.redact(name))
+	}
+
+	return redactedPath
+}
+
+/*
+Read the value of a from-file variable, without the final newline.  A
+secret in a file others can read is warned about on stderr.
+*/
+func readVarFile(path string, secret bool, stderr io.Writer) (string, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if secret && info.Mode().Perm()&0004 != 0 {
+		fmt.Fprintf(stderr, "dex: warning: %s is readable by everyone, chmod o-r %s\n", path, path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(content), "\n"), nil
+}
@@ -0,0 +1,200 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecrets(t *testing.T) {
+
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "token"), []byte("tok-5f2a9c\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "shared"), []byte("shared-81d3e0\n"), 0644)
+
+	config := `---
+version: 2
+vars:
+  token:
+    from-file: ` + filepath.Join(dir, "token") + `
+    secret: true
+  shared:
+    from-file: ` + filepath.Join(dir, "shared") + `
+    secret: true
+  password:
+    from-command: echo pw-7c41b2
+    secret: true
+  missing:
+    from-file: ` + filepath.Join(dir, "missing") + `
+    default: fallback-value
+    secret: true
+  user: admin
+blocks:
+  - name: deploy
+    desc: this is a command description
+    commands:
+      - diag: deploying as [% user %] with [% token %] and [% password %]
+      - exec: test "[% token %] [% shared %] [% password %]" = "tok-5f2a9c shared-81d3e0 pw-7c41b2"
+      - exec: test [% missing %] = fallback-value
+      - exec: echo [% user %]:[% password %] > /dev/null; exit 2
+        retry: 2
+        condition-shell: -n "[% shared %]"
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	logFile := filepath.Join(dir, "history.jsonl")
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	result, err := RunBlock(context.Background(), dexFile, []string{"deploy"}, RunOptions{
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+		LogFile: logFile,
+		Timings: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Exit)
+
+	history, _ := os.ReadFile(logFile)
+
+	timings := []string{}
+	for _, entry := range result.Timings.Entries() {
+		timings = append(timings, entry.Command)
+	}
+
+	assert.Equal(t, "deploying as admin with **** and ****\n", stdout.String())
+	assert.Contains(t, stderr.String(), "dex: warning: "+filepath.Join(dir, "shared")+" is readable by everyone")
+	assert.NotContains(t, stderr.String(), filepath.Join(dir, "token"))
+	assert.Contains(t, stderr.String(), "dex: failed with exit code 2 after 2 attempts: echo admin:**** > /dev/null; exit 2\n")
+	assert.Contains(t, string(history), `"command":"test \"**** **** ****\" = \"**** **** ****\""`)
+	assert.Contains(t, timings, "test **** = ****")
+
+	for _, secret := range []string{"tok-5f2a9c", "shared-81d3e0", "pw-7c41b2", "fallback-value"} {
+		assert.NotContains(t, stdout.String(), secret)
+		assert.NotContains(t, stderr.String(), secret)
+		assert.NotContains(t, string(history), secret)
+		assert.NotContains(t, timings, secret)
+	}
+
+	/* Dry runs show the commands with the secrets redacted */
+	var plan bytes.Buffer
+
+	_, err = RunBlock(context.Background(), dexFile, []string{"deploy"}, RunOptions{
+		Vars:     map[string]any{"password": "pw-override-0e93"},
+		Executor: &RecordingExecutor{Output: &plan},
+	})
+
+	assert.NoError(t, err)
+	assert.Contains(t, plan.String(), "dex: would run /bin/bash -c 'echo admin:**** > /dev/null; exit 2'")
+	assert.NotContains(t, plan.String(), "pw-override-0e93")
+	assert.NotContains(t, plan.String(), "tok-5f2a9c")
+}
+
+func TestSecretsPerRun(t *testing.T) {
+
+	secret, err := ParseConfig([]byte(`---
+version: 2
+vars:
+  token:
+    value: run-3b8e1f
+    secret: true
+  pin:
+    value: 42
+    secret: true
+blocks:
+  - name: show
+    desc: this is a command description
+    commands:
+      - diag: "[% token %] [% pin %]"
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	plain, err := ParseConfig([]byte(`---
+version: 2
+blocks:
+  - name: show
+    desc: this is a command description
+    commands:
+      - diag: run-3b8e1f
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	_, err = RunBlock(context.Background(), secret, []string{"show"}, RunOptions{Stdout: &stdout, Stderr: &stderr})
+	assert.NoError(t, err)
+
+	/* Secrets too short to redact would hide every 42 in the output */
+	assert.Equal(t, "**** 42\n", stdout.String())
+	assert.Equal(t, "dex: warning: secret pin is too short to redact\n", stderr.String())
+
+	stdout.Reset()
+
+	/* Another run does not know about the secrets of the first */
+	_, err = RunBlock(context.Background(), plain, []string{"show"}, RunOptions{Stdout: &stdout})
+	assert.NoError(t, err)
+	assert.Equal(t, "run-3b8e1f\n", stdout.String())
+}
+
+func TestSecretsInFailedRun(t *testing.T) {
+
+	dir := t.TempDir()
+
+	dexFile, err := ParseConfig([]byte(`---
+version: 2
+blocks:
+  - name: target-9d2c
+    desc: this is a command description
+    commands:
+      - exec: exit 5
+  - name: calls
+    desc: this is a command description
+    vars:
+      target:
+        value: target-9d2c
+        secret: true
+    commands:
+      - run: "[% target %]"
+    on-failure:
+      - exec: echo "[% failed_command %]" > ` + filepath.Join(dir, "failed") + `
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	logFile := filepath.Join(dir, "history.jsonl")
+
+	var stderr bytes.Buffer
+
+	result, err := RunBlock(context.Background(), dexFile, []string{"calls"}, RunOptions{Stderr: &stderr, LogFile: logFile, Timings: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 5, result.Exit)
+
+	failed, _ := os.ReadFile(filepath.Join(dir, "failed"))
+	history, _ := os.ReadFile(logFile)
+
+	assert.Equal(t, "run ****\n", string(failed))
+	assert.NotContains(t, string(history), "target-9d2c")
+	assert.NotContains(t, stderr.String(), "target-9d2c")
+
+	for _, entry := range result.Timings.Entries() {
+		assert.NotContains(t, entry.Block, "target-9d2c")
+	}
+}
@@ -0,0 +1,315 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+A shell that runs the commands of a block with session: true, so that
+exported variables, functions and the like carry over between commands.
+Commands are written to the shell on its stdin and each one is followed by
+a marker on stdout with its exit status, and one on stderr so all of its
+output reached its writers before the next command runs.  The shell is started when the
+first command runs, and again after a command ended it.  It only changes
+directory for a command with a different dir, so a cd carries over.
+*/
+type shellSession struct {
+	Shell  string
+	Stderr io.Writer
+	Env    []string
+
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	status    chan int
+	errStatus chan int
+	done      chan struct{}
+	marker    []byte
+	dir       string
+
+	/* Where the output of the running command goes, Stderr for its stderr
+	   when not set */
+	mutex sync.Mutex
+	out   io.Writer
+	err   io.Writer
+}
+
+/* Quote a string for a POSIX shell */
+func shellQuote(str string) string {
+	return "'" + string(bytes.ReplaceAll([]byte(str), []byte("'"), []byte(`'\''`))) + "'"
+}
+
+func (session *shellSession) start(dir string) error {
+
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+
+	session.marker = []byte("dex-session-" + hex.EncodeToString(token) + " ")
+
+	cmd := exec.Command(session.Shell)
+	cmd.Dir = dir
+	cmd.Env = commandEnv(session.Env)
+	setProcessGroup(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	/* Not StdoutPipe, which Wait would close before the output is read */
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutWriter.Close()
+		return err
+	}
+
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	/* The stderr marker goes to fd 9, in case a command redirects stderr of the session */
+	cmd.ExtraFiles = []*os.File{nil, nil, nil, nil, nil, nil, stderrWriter}
+
+	err = cmd.Start()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return err
+	}
+
+	session.cmd = cmd
+	session.dir = dir
+	session.stdin = stdin
+	session.status = make(chan int, 1)
+	session.errStatus = make(chan int, 1)
+	session.done = make(chan struct{})
+
+	go session.read(stdout, session.marker, session.status, session.write)
+	go session.read(stderr, session.marker, session.errStatus, session.writeErr)
+
+	go func(done chan struct{}) {
+		cmd.Wait()
+		close(done)
+	}(session.done)
+
+	return nil
+}
+
+/*
+Copy the output of the shell to the writer of the running command with
+write, and send the exit status of every marker found in it.
+*/
+func (session *shellSession) read(stdout io.ReadCloser, marker []byte, status chan int, write func([]byte)) {
+
+	defer close(status)
+	defer stdout.Close()
+
+	pending := []byte{}
+	chunk := make([]byte, 4096)
+
+	for {
+		n, err := stdout.Read(chunk)
+		pending = append(pending, chunk[:n]...)
+
+		for {
+			start := bytes.Index(pending, marker)
+			if start < 0 {
+				break
+			}
+
+			end := bytes.IndexByte(pending[start+len(marker):], '\n')
+			if end < 0 {
+				break
+			}
+
+			end += start + len(marker)
+
+			write(pending[:start])
+
+			code, _ := strconv.Atoi(string(pending[start+len(marker) : end]))
+			pending = pending[end+1:]
+
+			status <- code
+		}
+
+		/* Hold back a marker that is not complete yet */
+		keep := len(pending)
+
+		if start := bytes.Index(pending, marker); start >= 0 {
+			keep = len(pending) - start
+		} else {
+			for keep > 0 && !bytes.HasPrefix(marker, pending[len(pending)-keep:]) {
+				keep--
+			}
+		}
+
+		write(pending[:len(pending)-keep])
+		pending = pending[len(pending)-keep:]
+
+		if err != nil {
+			write(pending)
+			return
+		}
+	}
+}
+
+func (session *shellSession) write(data []byte) {
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if len(data) > 0 && session.out != nil {
+		session.out.Write(data)
+	}
+}
+
+/* Write stderr of the shell, under the same mutex as stdout as they can be the same writer */
+func (session *shellSession) writeErr(data []byte) {
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	w := session.err
+	if w == nil {
+		w = session.Stderr
+	}
+
+	if len(data) > 0 && w != nil {
+		w.Write(data)
+	}
+}
+
+/*
+Run a command in the shell, like execCommand.  The command is the last of
+the arguments, like for the shell and its -c option.
+*/
+func (session *shellSession) run(config ExecConfig) (int, error) {
+
+	if session.cmd == nil {
+		if err := session.start(config.Dir); err != nil {
+			fmt.Fprintf(config.Stderr, "dex: cannot start session: %v\n", err)
+			return 1, nil
+		}
+	}
+
+	session.mutex.Lock()
+	session.out = config.Stdout
+	session.err = config.Stderr
+	session.mutex.Unlock()
+
+	/* Output after the command, like of what it left running, goes to the block */
+	defer func() {
+		session.mutex.Lock()
+		session.err = nil
+		session.mutex.Unlock()
+	}()
+
+	script := ""
+	if len(config.Dir) > 0 && config.Dir != session.dir {
+		script = "cd -- " + shellQuote(config.Dir) + " && "
+		session.dir = config.Dir
+	}
+
+	/* The command must not read the rest of the session from stdin */
+	script += fmt.Sprintf("{\n%s\n} </dev/null; printf '%%s%%d\\n' %s \"$?\"; printf '%%s0\\n' %s >&9\n",
+		config.Args[len(config.Args)-1], shellQuote(string(session.marker)), shellQuote(string(session.marker)))
+
+	ctx, cancel := withTimeout(execContext(config), config.Timeout)
+	defer cancel()
+
+	io.WriteString(session.stdin, script)
+
+	select {
+	case code, ok := <-session.status:
+		if ok {
+			select {
+			case <-session.errStatus:
+			case <-session.done:
+			case <-ctx.Done():
+			}
+
+			return code, nil
+		}
+
+		/* The command ended the shell, the next one starts a new shell */
+		<-session.done
+
+		code = session.cmd.ProcessState.ExitCode()
+		session.cmd = nil
+
+		return max(code, 0), nil
+
+	case <-ctx.Done():
+		cause := context.Cause(ctx)
+
+		session.stop(cause, config.GracePeriod)
+
+		return cancelExitCode(cause), cause
+	}
+}
+
+/* Stop the shell and what it runs, after a timeout or interrupt */
+func (session *shellSession) stop(cause error, grace time.Duration) {
+
+	if grace <= 0 {
+		grace = DefaultGracePeriod
+	}
+
+	sig := terminateSignal
+
+	var interruptErr *InterruptError
+	if errors.As(cause, &interruptErr) {
+		sig = interruptErr.Signal
+	}
+
+	signalProcessGroup(session.cmd, sig)
+
+	select {
+	case <-session.done:
+	case <-time.After(grace):
+	}
+
+	signalProcessGroup(session.cmd, os.Kill)
+	<-session.done
+
+	session.cmd = nil
+}
+
+/* End the shell once the block is done */
+func (session *shellSession) close() {
+
+	if session.cmd == nil {
+		return
+	}
+
+	session.stdin.Close()
+
+	select {
+	case <-session.done:
+	case <-time.After(DefaultGracePeriod):
+		signalProcessGroup(session.cmd, os.Kill)
+		<-session.done
+	}
+
+	session.cmd = nil
+}
@@ -0,0 +1,130 @@
+package v2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+
+	tests := []struct {
+		DexTest
+		Exit int
+	}{
+		{
+			DexTest: DexTest{
+				Name: "shell state",
+				Config: `---
+version: 2
+blocks:
+  - name: session
+    desc: this is a command description
+    session: true
+    commands:
+      - exec: export GREETING=hello; greet() { echo "$GREETING $1"; }
+      - exec: greet [% var %]
+        for-vars: [one, two]
+        skip-if: var == "two"
+      - exec: printf 'no newline'
+      - exec: greet again
+      - exec: pwd
+        dir: /
+      - exec: greet
+        register: greeting
+      - exec: echo "registered $X"
+        condition: greeting == "hello"
+`,
+				BlockPath:  []string{"session"},
+				CommandOut: "hello one\nno newlinehello again\n/\nregistered \n",
+			},
+		},
+		{
+			DexTest: DexTest{
+				Name: "cd carries over",
+				Config: `---
+version: 2
+blocks:
+  - name: session
+    desc: this is a command description
+    session: true
+    commands:
+      - exec: cd /
+      - exec: pwd
+      - exec: cd /tmp
+        dir: /
+      - exec: pwd
+        dir: /
+      - exec: cd /tmp
+      - exec: pwd
+`,
+				BlockPath:  []string{"session"},
+				CommandOut: "/\n/\n/tmp\n",
+			},
+		},
+		{
+			DexTest: DexTest{
+				Name: "exit codes",
+				Config: `---
+version: 2
+blocks:
+  - name: session
+    desc: this is a command description
+    session: true
+    commands:
+      - exec: X=kept; false
+        register-exit-code: code
+      - exec: echo "[% code %] $X"
+      - exec: exit 4
+      - exec: echo "new shell $X"
+`,
+				BlockPath:  []string{"session"},
+				CommandOut: "1 kept\nnew shell \n",
+			},
+			Exit: 4,
+		},
+		{
+			DexTest: DexTest{
+				Name: "timeout",
+				Config: `---
+version: 2
+blocks:
+  - name: session
+    desc: this is a command description
+    session: true
+    commands:
+      - exec: sleep 5
+        timeout: 100ms
+    finally:
+      - exec: echo cleanup [% exit_code %]
+`,
+				BlockPath:  []string{"session"},
+				CommandOut: "dex: timed out after 100ms: sleep 5\ncleanup 124\n",
+			},
+			Exit: ExitTimeout,
+		},
+	}
+
+	for _, test := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test.DexTest)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+		}
+
+		assert.Equal(t, test.Exit, processBlock(block, config), test.Name)
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+	}
+}
@@ -0,0 +1,147 @@
+package v2
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+/*
+Replace every block that extends a template with the concrete block.  The
+template provides the fields the block leaves unset, and the vars of the
+block are added to those of the template, so the same commands can be run
+with different vars.  Templates can extend other templates.
+*/
+func expandTemplates(dexFile *DexFile2) error {
+
+	templates := map[string]Block{}
+
+	for _, template := range dexFile.Templates {
+		if len(template.Name) == 0 {
+			return fmt.Errorf("templates must have a name")
+		}
+
+		if _, ok := templates[template.Name]; ok {
+			return fmt.Errorf("duplicate template %s", template.Name)
+		}
+
+		templates[template.Name] = template
+	}
+
+	return expandBlocks(dexFile.Blocks, templates)
+}
+
+/* Expand the blocks and their children in place */
+func expandBlocks(blocks []Block, templates map[string]Block) error {
+
+	for i := range blocks {
+		block, err := extendBlock(blocks[i], templates, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := expandBlocks(block.Children, templates); err != nil {
+			return err
+		}
+
+		blocks[i] = block
+	}
+
+	return nil
+}
+
+/* Apply the template the block extends, following the chain of templates */
+func extendBlock(block Block, templates map[string]Block, chain []string) (Block, error) {
+
+	if len(block.Extends) == 0 {
+		return block, nil
+	}
+
+	chain = append(chain, block.Extends)
+
+	if slices.Contains(chain[:len(chain)-1], block.Extends) {
+		return Block{}, fmt.Errorf("templates extend each other: %s", strings.Join(chain, " -> "))
+	}
+
+	template, ok := templates[block.Extends]
+	if !ok {
+		return Block{}, fmt.Errorf("block %s extends unknown template %s", block.Name, block.Extends)
+	}
+
+	template, err := extendBlock(template, templates, chain)
+	if err != nil {
+		return Block{}, err
+	}
+
+	checkSetDefault(&block.Name, template.Name)
+	checkSetDefault(&block.Desc, template.Desc)
+	checkSetDefault(&block.Dir, template.Dir)
+	checkSetDefault(&block.Shell, template.Shell)
+	checkSetDefault(&block.ShellArgs, template.ShellArgs)
+	checkSetDefault(&block.Condition, template.Condition)
+	checkSetDefault(&block.RequiresEnv, template.RequiresEnv)
+	checkSetDefault(&block.RequiresCommands, template.RequiresCommands)
+	checkSetDefault(&block.OS, template.OS)
+	checkSetDefault(&block.Arch, template.Arch)
+	checkSetDefault(&block.Timeout, template.Timeout)
+	checkSetDefault(&block.For, template.For)
+	checkSetDefault(&block.Sources, template.Sources)
+	checkSetDefault(&block.Generates, template.Generates)
+	checkSetDefault(&block.Fingerprint, template.Fingerprint)
+	checkSetDefault(&block.Watch, template.Watch)
+	checkSetDefault(&block.Executor, template.Executor)
+	checkSetDefault(&block.Confirm, template.Confirm)
+	checkSetDefault(&block.ConfirmPhrase, template.ConfirmPhrase)
+
+	block.Session = block.Session || template.Session
+
+	if block.OutputRaw == nil {
+		block.OutputRaw = template.OutputRaw
+	}
+
+	if block.ContainerRaw == nil {
+		block.ContainerRaw = template.ContainerRaw
+	}
+
+	if block.RemoteRaw == nil {
+		block.RemoteRaw = template.RemoteRaw
+	}
+
+	if len(block.CommandsRaw) == 0 {
+		block.CommandsRaw = slices.Clone(template.CommandsRaw)
+	}
+
+	if len(block.FinallyRaw) == 0 {
+		block.FinallyRaw = slices.Clone(template.FinallyRaw)
+	}
+
+	if len(block.OnFailureRaw) == 0 {
+		block.OnFailureRaw = slices.Clone(template.OnFailureRaw)
+	}
+
+	if len(block.Children) == 0 {
+		block.Children = slices.Clone(template.Children)
+	}
+
+	if block.ForVars == nil {
+		block.ForVars = template.ForVars
+	}
+
+	if len(block.Matrix) == 0 {
+		block.Matrix = template.Matrix
+	}
+
+	/* The vars of the block are the parameters of the template */
+	vars := maps.Clone(template.Vars)
+	if vars == nil {
+		vars = map[string]any{}
+	}
+
+	maps.Copy(vars, block.Vars)
+
+	block.Vars = vars
+	block.Extends = ""
+
+	return block, nil
+}
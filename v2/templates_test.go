@@ -0,0 +1,198 @@
+package v2
+
+import (
+	"bytes"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplates(t *testing.T) {
+
+	config := `---
+version: 2
+templates:
+  - name: service
+    desc: restart a service
+    vars:
+      signal: HUP
+    commands:
+      - exec: echo restart [% service %] with [% signal %]
+  - name: web-service
+    extends: service
+    vars:
+      service: nginx
+blocks:
+  - name: api
+    extends: service
+    vars:
+      service: api
+  - name: web
+    desc: restart the web server
+    extends: web-service
+    vars:
+      signal: TERM
+  - name: group
+    desc: grouped services
+    children:
+      - name: worker
+        extends: service
+        vars:
+          service: worker
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var menu bytes.Buffer
+
+	displayMenu(&menu, dexFile.Blocks, 0)
+
+	assert.Equal(t, "api                     : restart a service\n"+
+		"web                     : restart the web server\n"+
+		"group                   : grouped services\n"+
+		"    worker                  : restart a service\n", menu.String())
+
+	tests := map[string][]string{
+		"restart api with HUP\n":    {"api"},
+		"restart nginx with TERM\n": {"web"},
+		"restart worker with HUP\n": {"group", "worker"},
+	}
+
+	for expected, blockPath := range tests {
+
+		VarCfgs = map[string]VarCfg{}
+
+		block, err := initBlockFromPath(dexFile, blockPath)
+		if !assert.NoError(t, err, blockPath) {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		processBlock(block, ExecConfig{Stdout: &output, Stderr: &output})
+
+		assert.Equal(t, expected, output.String(), blockPath)
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+
+	tests := map[string]string{
+		"block api extends unknown template missing": `---
+version: 2
+blocks:
+  - name: api
+    extends: missing
+`,
+		"templates extend each other: one -> two -> one": `---
+version: 2
+templates:
+  - name: one
+    extends: two
+  - name: two
+    extends: one
+blocks:
+  - name: api
+    extends: one
+`,
+		"duplicate template one": `---
+version: 2
+templates:
+  - name: one
+  - name: one
+blocks: []
+`,
+	}
+
+	for expected, config := range tests {
+
+		_, err := ParseConfig([]byte(config))
+
+		assert.EqualError(t, err, expected)
+	}
+}
+
+/*
+Every field of a template must reach the blocks extending it, so a field
+added to Block fails here until extendBlock copies it.
+*/
+func TestTemplateFields(t *testing.T) {
+
+	/* Parsed from the raw fields once the templates are expanded */
+	notInherited := map[string]bool{
+		"Extends":   true,
+		"Commands":  true,
+		"Output":    true,
+		"Container": true,
+		"Remote":    true,
+		"Finally":   true,
+		"OnFailure": true,
+	}
+
+	template := Block{}
+	fillValue(reflect.ValueOf(&template).Elem(), nil)
+	template.Extends = ""
+
+	block, err := extendBlock(Block{Extends: "base"}, map[string]Block{"base": template}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	value := reflect.ValueOf(block)
+
+	for _, field := range reflect.VisibleFields(value.Type()) {
+		if field.Anonymous || notInherited[field.Name] {
+			continue
+		}
+
+		assert.False(t, value.FieldByIndex(field.Index).IsZero(), "%s is not inherited from templates", field.Name)
+	}
+}
+
+/*
+Set value and everything in it to something other than its zero value, types
+already being filled are left empty so Children does not recurse forever
+*/
+func fillValue(value reflect.Value, filling []reflect.Type) {
+
+	if slices.Contains(filling, value.Type()) {
+		return
+	}
+
+	filling = append(filling, value.Type())
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString("set")
+
+	case reflect.Bool:
+		value.SetBool(true)
+
+	case reflect.Interface:
+		value.Set(reflect.ValueOf("set"))
+
+	case reflect.Slice:
+		value.Set(reflect.MakeSlice(value.Type(), 1, 1))
+		fillValue(value.Index(0), filling)
+
+	case reflect.Map:
+		key := reflect.New(value.Type().Key()).Elem()
+		elem := reflect.New(value.Type().Elem()).Elem()
+
+		fillValue(key, filling)
+		fillValue(elem, filling)
+
+		value.Set(reflect.MakeMap(value.Type()))
+		value.SetMapIndex(key, elem)
+
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			fillValue(value.Field(i), filling)
+		}
+	}
+}
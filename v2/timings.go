@@ -0,0 +1,175 @@
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* How long a block or command took, for --timings */
+type TimingEntry struct {
+	Kind     string   `json:"kind"`
+	Block    []string `json:"block"`
+	Command  string   `json:"command,omitempty"`
+	Status   string   `json:"status"`
+	Exit     int      `json:"exit"`
+	Duration float64  `json:"duration"`
+	Depth    int      `json:"depth"`
+}
+
+/*
+Collects the timings of a run in the order the blocks and commands started.
+A nil report records nothing.
+*/
+type TimingReport struct {
+	mutex   sync.Mutex
+	entries []TimingEntry
+	depth   int
+}
+
+/* Number of the slowest commands highlighted in the table */
+var slowestTimings = 3
+
+/* Start timing a block, returning the function that records its end */
+func (report *TimingReport) startBlock(path []string) func(exit int) {
+
+	if report == nil {
+		return func(int) {}
+	}
+
+	start := time.Now()
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	index := len(report.entries)
+	report.entries = append(report.entries, TimingEntry{Kind: "block", Block: path, Depth: report.depth})
+	report.depth++
+
+	return func(exit int) {
+		report.mutex.Lock()
+		defer report.mutex.Unlock()
+
+		report.entries[index].Status = "ran"
+		report.entries[index].Exit = exit
+		report.entries[index].Duration = time.Since(start).Seconds()
+		report.depth--
+	}
+}
+
+/* Record a command that ran from start until now */
+func (report *TimingReport) command(path []string, command string, start time.Time, exit int) {
+	report.add(TimingEntry{Kind: "command", Block: path, Command: command, Status: "ran", Exit: exit, Duration: time.Since(start).Seconds()})
+}
+
+/* Record a command whose conditions skipped it */
+func (report *TimingReport) skipped(path []string, command string) {
+	report.add(TimingEntry{Kind: "command", Block: path, Command: command, Status: "skipped"})
+}
+
+func (report *TimingReport) add(entry TimingEntry) {
+
+	if report == nil {
+		return
+	}
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	entry.Depth = report.depth
+	report.entries = append(report.entries, entry)
+}
+
+/* The timings recorded so far */
+func (report *TimingReport) Entries() []TimingEntry {
+
+	if report == nil {
+		return nil
+	}
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	return slices.Clone(report.entries)
+}
+
+/*
+Print the table of timings.  The slowest commands are marked with a * and
+highlighted when the writer is a terminal.
+*/
+func (report *TimingReport) Print(w io.Writer, color bool) {
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	slowest := map[int]bool{}
+	ran := []int{}
+
+	for index, entry := range report.entries {
+		if entry.Kind == "command" && entry.Status == "ran" {
+			ran = append(ran, index)
+		}
+	}
+
+	sort.SliceStable(ran, func(i, j int) bool {
+		return report.entries[ran[i]].Duration > report.entries[ran[j]].Duration
+	})
+
+	/* Only worth highlighting when some commands are not among them */
+	if len(ran) > slowestTimings {
+		for _, index := range ran[:slowestTimings] {
+			slowest[index] = true
+		}
+	}
+
+	fmt.Fprintf(w, "  %-10s  %-6s  %-8s  %s\n", "TIME", "EXIT", "STATUS", "STEP")
+
+	for index, entry := range report.entries {
+
+		mark, elapsed, exit := " ", "-", "-"
+
+		if slowest[index] {
+			mark = "*"
+		}
+
+		if entry.Status == "ran" {
+			elapsed = formatDuration(entry.Duration)
+			exit = fmt.Sprint(entry.Exit)
+		}
+
+		step := strings.Repeat("  ", entry.Depth) + entry.Command
+		if entry.Kind == "block" {
+			step = strings.Repeat("  ", entry.Depth) + "[" + strings.Join(entry.Block, " ") + "]"
+		}
+
+		line := fmt.Sprintf("%s %-10s  %-6s  %-8s  %s", mark, elapsed, exit, entry.Status, step)
+
+		if slowest[index] && color {
+			line = "\033[1;33m" + line + "\033[0m"
+		}
+
+		fmt.Fprintln(w, line)
+	}
+}
+
+/* Write the timings as JSON to the file at path */
+func (report *TimingReport) WriteJSON(path string) error {
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	data, err := json.MarshalIndent(struct {
+		Entries []TimingEntry `json:"entries"`
+	}{report.entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,95 @@
+package v2
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimings(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: ci
+    desc: this is a command description
+    commands:
+      - exec: sleep 0.3
+      - exec: echo lint
+        condition: false
+      - exec: sleep 0.2
+      - run: test
+      - exec: exit 2
+  - name: test
+    desc: this is a command description
+    commands:
+      - exec: sleep 0.1
+      - exec: "true"
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	VarCfgs = map[string]VarCfg{}
+
+	block, err := initBlockFromPath(dexFile, []string{"ci"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	report := &TimingReport{}
+
+	var output bytes.Buffer
+
+	processBlock(block, ExecConfig{
+		Stdout:  &output,
+		Stderr:  &output,
+		File:    &dexFile,
+		Calls:   []string{"ci"},
+		Path:    []string{"ci"},
+		Timings: report,
+	})
+
+	var table bytes.Buffer
+
+	report.Print(&table, false)
+
+	assert.Regexp(t, regexp.MustCompile(`^  TIME        EXIT    STATUS    STEP
+  \S+\s+2\s+ran       \[ci\]
+\* \S+\s+0\s+ran         sleep 0.3
+  -           -       skipped     echo lint
+\* \S+\s+0\s+ran         sleep 0.2
+  \S+\s+0\s+ran         \[test\]
+\* \S+\s+0\s+ran           sleep 0.1
+  \S+\s+0\s+ran           true
+  \S+\s+2\s+ran         exit 2
+$`), table.String())
+
+	path := filepath.Join(t.TempDir(), "timings.json")
+
+	if !assert.NoError(t, report.WriteJSON(path)) {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	var exported struct {
+		Entries []TimingEntry `json:"entries"`
+	}
+
+	assert.NoError(t, json.Unmarshal(data, &exported))
+
+	if assert.Len(t, exported.Entries, 8) {
+		assert.Equal(t, TimingEntry{Kind: "command", Block: []string{"ci"}, Command: "echo lint", Status: "skipped", Depth: 1}, exported.Entries[2])
+		assert.Equal(t, []string{"test"}, exported.Entries[4].Block)
+		assert.Greater(t, exported.Entries[1].Duration, 0.25)
+	}
+}
@@ -0,0 +1,295 @@
+package v2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+/* Name of the file in the state directory with the fingerprints of blocks */
+const stateFileName = "state.json"
+
+/*
+Expand glob patterns relative to dir into the files they match, sorted and
+without duplicates.  Besides the filepath.Match syntax, ** matches any
+number of directories.
+*/
+func globFiles(dir string, patterns []string) ([]string, error) {
+
+	found := map[string]bool{}
+
+	for _, pattern := range patterns {
+
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		if !strings.Contains(pattern, "**") {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+
+			for _, match := range matches {
+				if info, err := os.Stat(match); err == nil && !info.IsDir() {
+					found[match] = true
+				}
+			}
+
+			continue
+		}
+
+		/* Walk from the last directory before any wildcard */
+		root := pattern[:strings.IndexAny(pattern, "*?[")]
+		root = root[:strings.LastIndex(root, string(filepath.Separator))+1]
+
+		re, err := globRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() && re.MatchString(path) {
+				found[path] = true
+			}
+
+			return nil
+		})
+	}
+
+	files := []string{}
+
+	for file := range found {
+		files = append(files, file)
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+/* Translate a glob with ** into a regular expression for whole paths */
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+
+	var expr strings.Builder
+
+	expr.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch char := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case char == '*':
+			expr.WriteString("[^/]*")
+		case char == '?':
+			expr.WriteString("[^/]")
+		case char == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid pattern %q", pattern)
+			}
+
+			expr.WriteString(pattern[i : i+end+1])
+			i += end
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
+
+/*
+Fingerprint of the sources of a block and of its commands as rendered with
+the variables, so changing either makes the block stale.  Sources are
+compared by content, or by modification time and size with
+fingerprint: mtime.
+*/
+func blockFingerprint(block Block, varCfgs map[string]VarCfg, dir string) (string, error) {
+
+	hash := sha256.New()
+
+	for _, command := range block.Commands {
+		fmt.Fprintf(hash, "command\x00%s\x00%s\x00%s\x00%s\x00", render(command.Exec, varCfgs),
+			render(command.Script, varCfgs), render(command.Run, varCfgs), render(command.Dir, varCfgs))
+	}
+
+	files, err := globFiles(dir, block.Sources)
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		fmt.Fprintf(hash, "file\x00%s\x00", file)
+
+		if block.Fingerprint == "mtime" {
+			info, err := os.Stat(file)
+			if err != nil {
+				return "", err
+			}
+
+			fmt.Fprintf(hash, "%d\x00%d\x00", info.ModTime().UnixNano(), info.Size())
+			continue
+		}
+
+		content, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(hash, content)
+		content.Close()
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+Where the state of blocks with sources is kept: .dex next to the DexFile,
+or in the current directory when it is not known where the DexFile is.
+*/
+func blockStateDir(dexFile DexFile2) string {
+
+	stateDir := ".dex"
+	if len(dexFile.Path) > 0 {
+		stateDir = filepath.Join(filepath.Dir(dexFile.Path), stateDir)
+	}
+
+	if abs, err := filepath.Abs(stateDir); err == nil {
+		stateDir = abs
+	}
+
+	return stateDir
+}
+
+/* Fingerprints of the blocks that last ran successfully, by block path */
+func readState(stateDir string) map[string]string {
+
+	state := map[string]string{}
+
+	if data, err := os.ReadFile(filepath.Join(stateDir, stateFileName)); err == nil {
+		json.Unmarshal(data, &state)
+	}
+
+	return state
+}
+
+func writeState(stateDir string, path []string, fingerprint string) error {
+
+	state := readState(stateDir)
+	state[strings.Join(path, " ")] = fingerprint
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(stateDir, stateFileName), append(data, '\n'), 0644)
+}
+
+/*
+Why the block has to run, or an empty string when it is up to date: its
+sources and commands are the same as when it last succeeded and all of
+its generates patterns match files.
+*/
+func staleReason(block Block, varCfgs map[string]VarCfg, dir string, stateDir string, path []string) (string, string) {
+
+	fingerprint, err := blockFingerprint(block, varCfgs, dir)
+	if err != nil {
+		return err.Error(), ""
+	}
+
+	last, ok := readState(stateDir)[strings.Join(path, " ")]
+
+	switch {
+	case !ok:
+		return "never ran", fingerprint
+	case last != fingerprint:
+		return "sources changed", fingerprint
+	}
+
+	for _, pattern := range block.Generates {
+		if files, err := globFiles(dir, []string{pattern}); err != nil || len(files) == 0 {
+			return fmt.Sprintf("%s is missing", pattern), fingerprint
+		}
+	}
+
+	return "", fingerprint
+}
+
+/*
+The status builtin: list the blocks with sources and whether they are up
+to date, or why they have to run.  Their variables are initialized with
+config like for a run, so from-command variables run and secret ones are
+redacted.
+*/
+func runStatus(dexFile DexFile2, args []string, config ExecConfig) int {
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+		return 1
+	}
+
+	globals := VarCfgs
+
+	var status func(blocks []Block, parent []string)
+
+	status = func(blocks []Block, parent []string) {
+		for _, block := range blocks {
+
+			path := append(slices.Clone(parent), block.Name)
+
+			if len(block.Sources) > 0 {
+				VarCfgs = maps.Clone(globals)
+
+				initialized, err := initBlockWithVars(dexFile, path, VarCfgs, nil, config)
+
+				dir := cwd
+				checkSetOverride(&dir, initialized.Dir)
+
+				reason := "up to date"
+
+				if err != nil {
+					reason = err.Error()
+				} else if stale, _ := staleReason(initialized, VarCfgs, dir, config.StateDir, path); len(stale) > 0 {
+					reason = "stale: " + stale
+				}
+
+				fmt.Fprintf(config.Stdout, "%-32s %s\n", strings.Join(path, " "), config.Secrets.redact(reason))
+			}
+
+			status(block.Children, path)
+		}
+	}
+
+	status(dexFile.Blocks, nil)
+
+	VarCfgs = globals
+
+	return 0
+}
@@ -0,0 +1,314 @@
+package v2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobFiles(t *testing.T) {
+
+	dir := t.TempDir()
+
+	for _, name := range []string{"main.go", "README.md", "cmd/dex/main.go", "cmd/dex/testdata/input.txt", "v2/v2.go"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	tests := []struct {
+		Patterns []string
+		Expected []string
+	}{
+		{
+			Patterns: []string{"*.go"},
+			Expected: []string{"main.go"},
+		},
+		{
+			Patterns: []string{"**/*.go"},
+			Expected: []string{"cmd/dex/main.go", "main.go", "v2/v2.go"},
+		},
+		{
+			Patterns: []string{"cmd/**", "*.md", "cmd/dex/main.go"},
+			Expected: []string{"README.md", "cmd/dex/main.go", "cmd/dex/testdata/input.txt"},
+		},
+		{
+			Patterns: []string{"v[0-9]/*.go", "missing/*"},
+			Expected: []string{"v2/v2.go"},
+		},
+	}
+
+	for _, test := range tests {
+
+		files, err := globFiles(dir, test.Patterns)
+
+		expected := []string{}
+		for _, name := range test.Expected {
+			expected = append(expected, filepath.Join(dir, name))
+		}
+
+		assert.NoError(t, err, test.Patterns)
+		assert.Equal(t, expected, files, test.Patterns)
+	}
+}
+
+func TestSources(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: build
+    desc: this is a command description
+    sources: ["src/*.txt"]
+    generates: [out.txt]
+    commands:
+      - exec: cat src/*.txt > out.txt; echo built
+  - name: lint
+    desc: this is a command description
+    sources: ["src/**"]
+    fingerprint: mtime
+    commands:
+      - exec: echo linted
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, ".dex")
+
+	os.MkdirAll(filepath.Join(dir, "src"), 0755)
+	os.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("a\n"), 0644)
+
+	steps := []struct {
+		Name     string
+		Setup    func()
+		Force    bool
+		Expected string
+	}{
+		{
+			Name:     "first run",
+			Expected: "built\n",
+		},
+		{
+			Name:     "unchanged",
+			Expected: "dex: [build] is up to date\n",
+		},
+		{
+			Name:     "forced",
+			Force:    true,
+			Expected: "built\n",
+		},
+		{
+			Name: "source changed",
+			Setup: func() {
+				os.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("b\n"), 0644)
+			},
+			Expected: "built\n",
+		},
+		{
+			Name: "source added",
+			Setup: func() {
+				os.WriteFile(filepath.Join(dir, "src", "b.txt"), []byte("c\n"), 0644)
+			},
+			Expected: "built\n",
+		},
+		{
+			Name: "generated file missing",
+			Setup: func() {
+				os.Remove(filepath.Join(dir, "out.txt"))
+			},
+			Expected: "built\n",
+		},
+		{
+			Name:     "up to date again",
+			Expected: "dex: [build] is up to date\n",
+		},
+	}
+
+	for _, step := range steps {
+
+		if step.Setup != nil {
+			step.Setup()
+		}
+
+		VarCfgs = map[string]VarCfg{}
+
+		block, err := initBlockFromPath(dexFile, []string{"build"})
+		if !assert.NoError(t, err, step.Name) {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		exit := processBlock(block, ExecConfig{
+			Stdout:   &output,
+			Stderr:   &output,
+			Dir:      dir,
+			Path:     []string{"build"},
+			StateDir: stateDir,
+			Force:    step.Force,
+		})
+
+		assert.Equal(t, 0, exit, step.Name)
+		assert.Equal(t, step.Expected, output.String(), step.Name)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b\nc\n", string(content))
+
+	/* A failed run does not count as up to date */
+	VarCfgs = map[string]VarCfg{}
+
+	block, _ := initBlockFromPath(dexFile, []string{"lint"})
+	block.Commands[0].Exec = "exit 1"
+
+	var output bytes.Buffer
+
+	exit := processBlock(block, ExecConfig{Stdout: &output, Stderr: &output, Dir: dir, Path: []string{"lint"}, StateDir: stateDir})
+
+	assert.Equal(t, 1, exit)
+	assert.NotContains(t, readState(stateDir), "lint")
+}
+
+func TestStatus(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: build
+    desc: this is a command description
+    sources: ["*.txt"]
+    commands:
+      - exec: echo built
+  - name: docs
+    desc: this is a command description
+    children:
+      - name: html
+        desc: this is a command description
+        sources: ["*.md"]
+        commands:
+          - exec: echo html
+  - name: clean
+    desc: this is a command description
+    commands:
+      - exec: echo cleaned
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, ".dex")
+
+	os.WriteFile(filepath.Join(dir, "input.txt"), []byte("input\n"), 0644)
+
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	VarCfgs = map[string]VarCfg{}
+
+	block, err := initBlockFromPath(dexFile, []string{"build"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var output bytes.Buffer
+
+	processBlock(block, ExecConfig{Stdout: &output, Stderr: &output, Dir: dir, Path: []string{"build"}, StateDir: stateDir})
+
+	output.Reset()
+
+	exit := runStatus(dexFile, []string{}, ExecConfig{Stdout: &output, Stderr: &output, StateDir: stateDir})
+
+	assert.Equal(t, 0, exit)
+	assert.Equal(t, "build                            up to date\ndocs html                        stale: never ran\n", output.String())
+
+	os.WriteFile(filepath.Join(dir, "input.txt"), []byte("changed\n"), 0644)
+
+	output.Reset()
+
+	runStatus(dexFile, []string{}, ExecConfig{Stdout: &output, Stderr: &output, StateDir: stateDir})
+
+	assert.Equal(t, "build                            stale: sources changed\ndocs html                        stale: never ran\n", output.String())
+}
+
+func TestBlockStateDir(t *testing.T) {
+
+	cwd, _ := os.Getwd()
+
+	tests := []struct {
+		Name     string
+		Path     string
+		StateDir string
+	}{
+		{Name: "absolute", Path: "/srv/project/dex.yaml", StateDir: "/srv/project/.dex"},
+		{Name: "relative", Path: "sub/dex.yaml", StateDir: filepath.Join(cwd, "sub", ".dex")},
+		{Name: "in the current directory", Path: "dex.yaml", StateDir: filepath.Join(cwd, ".dex")},
+		{Name: "unknown", StateDir: filepath.Join(cwd, ".dex")},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.StateDir, blockStateDir(DexFile2{Path: test.Path}), test.Name)
+	}
+}
+
+/* Status sees the variables a run sees, and keeps the secrets among them */
+func TestStatusFromCommand(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: deploy
+    desc: this is a command description
+    sources: ["*.txt"]
+    vars:
+      token:
+        from-command: echo s3cr3t-token
+        secret: true
+    commands:
+      - exec: echo deploying with [% token %]
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, ".dex")
+
+	os.WriteFile(filepath.Join(dir, "input.txt"), []byte("input\n"), 0644)
+
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	VarCfgs = map[string]VarCfg{}
+
+	block, err := initBlockFromPath(dexFile, []string{"deploy"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var output bytes.Buffer
+
+	processBlock(block, ExecConfig{Stdout: &output, Stderr: &output, Dir: dir, Path: []string{"deploy"}, StateDir: stateDir})
+
+	output.Reset()
+
+	secrets := &secretValues{}
+
+	runStatus(dexFile, []string{}, ExecConfig{Stdout: &output, Stderr: &output, StateDir: stateDir, Secrets: secrets})
+
+	assert.Equal(t, "deploy                           up to date\n", output.String())
+	assert.Equal(t, "token ****", secrets.redact("token s3cr3t-token"))
+}
@@ -2,50 +2,210 @@ package v2
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"maps"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
-	"text/template"
+	"time"
 
 	"github.com/goccy/go-yaml"
 )
 
+/* The kind of value held by a VarCfg */
+type VarType int
+
+const (
+	UndefinedVar VarType = iota
+	StringVar
+	BoolVar
+	IntVar
+	FloatVar
+	ListVar
+	MapVar
+)
+
 type VarCfg struct {
+	Type        VarType
 	StringValue string
-	ListValue   []string
+	BoolValue   bool
+	IntValue    int64
+	FloatValue  float64
+	ListValue   []VarCfg
+	MapValue    map[string]VarCfg
 	FromCommand string
 	FromEnv     string
-	Default     string
+	FromFile    string
+	Default     any
+	Timeout     time.Duration
+	Retry       Retry
+
+	/* Redact the value from everything dex writes, see redact */
+	Secret bool
 }
 
+/* Return the native Go value of the variable */
 func (varCfg VarCfg) Value() (any, error) {
 
-	if len(varCfg.StringValue) > 0 {
-		return varCfg.Value, nil
-	} else if len(varCfg.ListValue) > 0 {
-		return varCfg.ListValue, nil
+	switch varCfg.Type {
+	case StringVar:
+		return varCfg.StringValue, nil
+	case BoolVar:
+		return varCfg.BoolValue, nil
+	case IntVar:
+		return varCfg.IntValue, nil
+	case FloatVar:
+		return varCfg.FloatValue, nil
+	case ListVar:
+		list := make([]any, 0, len(varCfg.ListValue))
+
+		for _, elem := range varCfg.ListValue {
+			value, _ := elem.Value()
+			list = append(list, value)
+		}
+
+		return list, nil
+	case MapVar:
+		valueMap := make(map[string]any, len(varCfg.MapValue))
+
+		for key, elem := range varCfg.MapValue {
+			valueMap[key], _ = elem.Value()
+		}
+
+		return valueMap, nil
 	}
 
 	return nil, errors.New("undefined")
 }
 
+/*
+Format the variable for use in a rendered template.  Lists are joined
+with spaces and maps are rendered as space separated key=value pairs
+sorted by key.
+*/
+func (varCfg VarCfg) String() string {
+
+	switch varCfg.Type {
+	case StringVar:
+		return varCfg.StringValue
+	case BoolVar:
+		return strconv.FormatBool(varCfg.BoolValue)
+	case IntVar:
+		return strconv.FormatInt(varCfg.IntValue, 10)
+	case FloatVar:
+		return strconv.FormatFloat(varCfg.FloatValue, 'f', -1, 64)
+	case ListVar:
+		elems := make([]string, 0, len(varCfg.ListValue))
+
+		for _, elem := range varCfg.ListValue {
+			elems = append(elems, elem.String())
+		}
+
+		return strings.Join(elems, " ")
+	case MapVar:
+		keys := make([]string, 0, len(varCfg.MapValue))
+		elems := make([]string, 0, len(varCfg.MapValue))
+
+		for key := range varCfg.MapValue {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			elems = append(elems, key+"="+varCfg.MapValue[key].String())
+		}
+
+		return strings.Join(elems, " ")
+	}
+
+	return ""
+}
+
+/*
+Walk a dotted path like db.host or hosts.0 into map and list values.
+*/
+func (varCfg VarCfg) Lookup(path []string) (VarCfg, bool) {
+
+	if len(path) == 0 {
+		return varCfg, varCfg.Type != UndefinedVar
+	}
+
+	switch varCfg.Type {
+	case MapVar:
+		if elem, ok := varCfg.MapValue[path[0]]; ok {
+			return elem.Lookup(path[1:])
+		}
+	case ListVar:
+		if index, err := strconv.Atoi(path[0]); err == nil && index >= 0 && index < len(varCfg.ListValue) {
+			return varCfg.ListValue[index].Lookup(path[1:])
+		}
+	}
+
+	return VarCfg{}, false
+}
+
+/* Find a variable by name, following dotted paths into maps and lists */
+func lookupVar(varCfgs map[string]VarCfg, name string) (VarCfg, bool) {
+
+	path := strings.Split(name, ".")
+
+	if varCfg, ok := varCfgs[path[0]]; ok {
+		return varCfg.Lookup(path[1:])
+	}
+
+	return VarCfg{}, false
+}
+
 type VarValue interface {
-	string | []string
+	string | bool | int64 | float64 | []string | []VarCfg | map[string]VarCfg
 }
 
 func SetVarValue[Value VarValue](varCfg *VarCfg, value Value) error {
 	switch typeValue := any(value).(type) {
 	case []string:
+		varCfg.Type = ListVar
+		varCfg.ListValue = make([]VarCfg, 0, len(typeValue))
+
+		for _, elem := range typeValue {
+			varCfg.ListValue = append(varCfg.ListValue, VarCfg{Type: StringVar, StringValue: elem})
+		}
+
+	case []VarCfg:
+		varCfg.Type = ListVar
 		varCfg.ListValue = typeValue
 
+	case map[string]VarCfg:
+		varCfg.Type = MapVar
+		varCfg.MapValue = typeValue
+
 	case string:
+		varCfg.Type = StringVar
 		varCfg.StringValue = typeValue
+
+	case bool:
+		varCfg.Type = BoolVar
+		varCfg.BoolValue = typeValue
+
+	case int64:
+		varCfg.Type = IntVar
+		varCfg.IntValue = typeValue
+
+	case float64:
+		varCfg.Type = FloatVar
+		varCfg.FloatValue = typeValue
+
 	default:
 		return errors.New("unknown VarCfg value type")
 	}
@@ -53,14 +213,93 @@ func SetVarValue[Value VarValue](varCfg *VarCfg, value Value) error {
 	return nil
 }
 
+/*
+Build a VarCfg from a value decoded from YAML, recursing into lists and maps.
+*/
+func newVarCfg(value any) (VarCfg, error) {
+
+	varCfg := VarCfg{}
+
+	switch typeVal := value.(type) {
+	case nil:
+		return varCfg, nil
+	case string:
+		SetVarValue(&varCfg, typeVal)
+	case bool:
+		SetVarValue(&varCfg, typeVal)
+	case int64:
+		SetVarValue(&varCfg, typeVal)
+	case int:
+		SetVarValue(&varCfg, int64(typeVal))
+	case uint64:
+		if typeVal > math.MaxInt64 {
+			SetVarValue(&varCfg, strconv.FormatUint(typeVal, 10))
+		} else {
+			SetVarValue(&varCfg, int64(typeVal))
+		}
+	case float64:
+		SetVarValue(&varCfg, typeVal)
+	case []any:
+		list := make([]VarCfg, 0, len(typeVal))
+
+		for _, elem := range typeVal {
+			elemCfg, err := newVarCfg(elem)
+			if err != nil {
+				return VarCfg{}, err
+			}
+
+			list = append(list, elemCfg)
+		}
+
+		SetVarValue(&varCfg, list)
+	case map[string]any:
+		valueMap := make(map[string]VarCfg, len(typeVal))
+
+		for key, elem := range typeVal {
+			elemCfg, err := newVarCfg(elem)
+			if err != nil {
+				return VarCfg{}, err
+			}
+
+			valueMap[key] = elemCfg
+		}
+
+		SetVarValue(&varCfg, valueMap)
+	default:
+		return VarCfg{}, fmt.Errorf("unknown type %T", typeVal)
+	}
+
+	return varCfg, nil
+}
+
 type Command struct {
-	Exec      string
-	Diag      string
-	Dir       string
-	ForVars   []string
-	Shell     string
-	ShellArgs []string
-	Condition string
+	Exec             string
+	Diag             string
+	Note             string
+	Warn             string
+	Error            string
+	Dir              string
+	Shell            string
+	ShellArgs        []string
+	Condition        string
+	ConditionShell   string
+	OnlyIf           string
+	SkipIf           string
+	Timeout          string
+	Retry            Retry
+	Register         string
+	RegisterExitCode string
+	Run              string
+	With             map[string]any
+	Script           string
+	Interpreter      string
+	Stdin            string
+	Output           Output
+	Container        Container
+	Remote           Remote
+	Confirm          string
+	ConfirmPhrase    string
+	Loop
 }
 
 type Block struct {
@@ -73,21 +312,79 @@ type Block struct {
 	Shell       string           `yaml:"shell"`
 	ShellArgs   []string         `yaml:"shell_args"`
 	Children    []Block          `yaml:"children"`
+
+	/* Name of the template the block is made from */
+	Extends string `yaml:"extends"`
+
+	Condition        string   `yaml:"condition"`
+	RequiresEnv      []string `yaml:"requires-env"`
+	RequiresCommands []string `yaml:"requires-commands"`
+	OS               []string `yaml:"os"`
+	Arch             []string `yaml:"arch"`
+	Timeout          string   `yaml:"timeout"`
+
+	/* Run the commands in a single shell */
+	Session bool `yaml:"session"`
+
+	/* Ask before running the commands, and a word to type to answer */
+	Confirm       string `yaml:"confirm"`
+	ConfirmPhrase string `yaml:"confirm-phrase"`
+
+	/* Where the output of the commands goes */
+	OutputRaw any    `yaml:"output"`
+	Output    Output `yaml:"Output"`
+
+	/* Name of the executor that runs the commands, see RegisterExecutor */
+	Executor string `yaml:"executor"`
+
+	/* The container the commands run in */
+	ContainerRaw any       `yaml:"container"`
+	Container    Container `yaml:"Container"`
+
+	/* The host the commands run on over ssh */
+	RemoteRaw any    `yaml:"remote"`
+	Remote    Remote `yaml:"Remote"`
+
+	/* Skip the block when its sources did not change since it last succeeded */
+	Sources     []string `yaml:"sources"`
+	Generates   []string `yaml:"generates"`
+	Fingerprint string   `yaml:"fingerprint"`
+
+	/* Files dex watch reruns the block for, its sources when not set */
+	Watch []string `yaml:"watch"`
+
+	/* Commands run after the block even when it failed or was stopped */
+	FinallyRaw   []map[string]any `yaml:"finally"`
+	OnFailureRaw []map[string]any `yaml:"on-failure"`
+	Finally      []Command        `yaml:"Finally"`
+	OnFailure    []Command        `yaml:"OnFailure"`
+
+	/* Loops over the whole list of commands */
+	Loop `yaml:",inline"`
 }
 type DexFile2 struct {
 	Version   int            `yaml:"version"`
 	Vars      map[string]any `yaml:"vars"`
 	Blocks    []Block        `yaml:"blocks"`
+	Templates []Block        `yaml:"templates"`
 	Shell     string         `yaml:"shell"`
 	ShellArgs []string       `yaml:"shell_args"`
+
+	/* Where the DexFile was loaded from, empty when it was only parsed */
+	Path string `yaml:"-"`
 }
 
 var DefaultShell = "/bin/bash"
 var DefaultShellArgs = []string{"-c"}
 var VarCfgs = map[string]VarCfg{}
 
+/* Field types that can be defaulted or overridden */
+type fieldValue interface {
+	string | []string
+}
+
 /* Helper function to set default value if field value is unset */
-func checkSetDefault[D VarValue](field *D, def D) {
+func checkSetDefault[D fieldValue](field *D, def D) {
 
 	if len(*field) == 0 {
 		*field = def
@@ -95,7 +392,7 @@ func checkSetDefault[D VarValue](field *D, def D) {
 }
 
 /* Helper function to set field value if override value is set */
-func checkSetOverride[D VarValue](field *D, override D) {
+func checkSetOverride[D fieldValue](field *D, override D) {
 
 	if len(override) != 0 {
 		*field = override
@@ -116,6 +413,10 @@ func ParseConfig(configData []byte) (DexFile2, error) {
 		return DexFile2{}, errors.New("incorrect version number")
 	}
 
+	if err := expandTemplates(&dexFile); err != nil {
+		return DexFile2{}, err
+	}
+
 	checkSetDefault(&dexFile.Shell, DefaultShell)
 	checkSetDefault(&dexFile.ShellArgs, DefaultShellArgs)
 
@@ -128,64 +429,370 @@ func ParseConfig(configData []byte) (DexFile2, error) {
 */
 func Run(dexFile DexFile2, args []string) {
 
+	/* Options come before the block path, like dex --verbose server restart */
+	flags := flag.NewFlagSet("dex", flag.ContinueOnError)
+	verbose := flags.Bool("verbose", false, "report skipped commands and iterations")
+	flags.BoolVar(verbose, "v", false, "shorthand for --verbose")
+	quiet := flags.Bool("quiet", false, "do not print diag and note messages")
+	flags.BoolVar(quiet, "q", false, "shorthand for --quiet")
+	color := flags.String("color", "auto", "color warnings and errors: auto, always or never")
+	timeout := flags.Duration("timeout", 0, "stop the block after this long, like 10m")
+	gracePeriod := flags.Duration("grace-period", DefaultGracePeriod, "time commands get to exit after a signal before they are killed")
+	logFile := flags.String("log-file", defaultLogFile(), "file to log the commands that run to, empty to disable")
+	force := flags.Bool("force", false, "run blocks with sources even when they are up to date")
+	dryRun := flags.Bool("dry-run", false, "show the commands the block would run without running them")
+	yes := flags.Bool("yes", false, "answer yes to confirm prompts")
+	flags.BoolVar(yes, "y", false, "shorthand for --yes")
+	timings := flags.Bool("timings", false, "print how long every block and command took")
+	timingsJSON := flags.String("timings-json", "", "write the timings as JSON to this file")
+
+	if err := flags.Parse(args[1:]); errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	if !slices.Contains(colorModes, *color) {
+		fmt.Fprintf(os.Stderr, "dex: invalid --color %q, expected auto, always or never\n", *color)
+		os.Exit(2)
+	}
+
+	blockPath := flags.Args()
+
 	/* No commands asked for: show menu and exit */
 
-	if len(args) == 1 {
+	if len(blockPath) == 0 {
 		displayMenu(os.Stdout, dexFile.Blocks, 0)
 		os.Exit(0)
 	}
 
-	initVars(dexFile.Vars)
+	stateDir := blockStateDir(dexFile)
+
+	/* Builtin commands, unless the DexFile has a block by the same name */
+	if builtin, ok := builtins[blockPath[0]]; ok && !hasBlock(dexFile.Blocks, blockPath[0]) {
+		config := ExecConfig{
+			Stdout:      os.Stdout,
+			Stderr:      os.Stderr,
+			Verbose:     *verbose,
+			Quiet:       *quiet,
+			Color:       *color,
+			GracePeriod: *gracePeriod,
+			Logger:      &ExecLogger{Path: *logFile},
+			StateDir:    stateDir,
+			Force:       *force,
+			Yes:         *yes,
+			Secrets:     &secretValues{},
+		}
+
+		initScopeVars(VarCfgs, dexFile.Vars, config)
+
+		if isTerminal(os.Stdin) && isTerminal(os.Stderr) {
+			config.Prompt = os.Stdin
+		}
+
+		os.Exit(builtin(dexFile, blockPath[1:], config))
+	}
+
+	/* Ctrl-C and SIGTERM cancel the run, which forwards the signal to the
+	   running command instead of leaving it behind.  Finally and on-failure
+	   commands still run, until a second signal stops them too */
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	cleanupCtx, cancelCleanup := context.WithCancelCause(context.Background())
+	defer cancelCleanup(nil)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardSignals...)
+
+	go func() {
+		sig := <-signals
+		cancel(&InterruptError{Signal: sig})
+
+		sig = <-signals
+		cancelCleanup(&InterruptError{Signal: sig})
+	}()
+
+	options := RunOptions{
+		Stdout:      os.Stdout,
+		Stderr:      os.Stderr,
+		Verbose:     *verbose,
+		Quiet:       *quiet,
+		Color:       *color,
+		Timeout:     *timeout,
+		GracePeriod: *gracePeriod,
+		Cleanup:     cleanupCtx,
+		LogFile:     *logFile,
+		StateDir:    stateDir,
+		Force:       *force,
+		Timings:     *timings || len(*timingsJSON) > 0,
+		Yes:         *yes,
+	}
+
+	/* Confirm prompts are only asked on a terminal */
+	if isTerminal(os.Stdin) && isTerminal(os.Stderr) {
+		options.Prompt = os.Stdin
+	}
+
+	/* Commands get the terminal, so Ctrl-C reaches them and they can prompt */
+	options.Foreground = isTerminal(os.Stdin)
+
+	/* Nothing runs, so there is nothing to log, remember or confirm either */
+	if *dryRun {
+		options.Executor = &RecordingExecutor{Output: os.Stdout}
+		options.LogFile = ""
+		options.StateDir = ""
+		options.Yes = true
+	}
+
+	result, err := RunBlock(ctx, dexFile, blockPath, options)
 
-	block, err := initBlockFromPath(dexFile, args[1:])
+	var guardErr *BlockGuardError
+	var notFoundErr *BlockNotFoundError
+
+	switch {
+	/* The block exists but its guards failed: say why and exit */
+	case errors.As(err, &guardErr):
+		fmt.Fprint(os.Stderr, err.Error()+"\n")
+		os.Exit(1)
 
 	/* No commands were found from the arguments the user passed: show error, menu and exit */
-	if err != nil {
+	case errors.As(err, &notFoundErr):
 		fmt.Fprint(os.Stderr, err.Error()+"\n")
 		displayMenu(os.Stderr, dexFile.Blocks, 0)
 		os.Exit(1)
+
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "dex: %v\n", err)
+		os.Exit(result.Exit)
+	}
+
+	if *timings {
+		result.Timings.Print(os.Stderr, useColor(os.Stderr))
 	}
 
-	config := ExecConfig{
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+	if len(*timingsJSON) > 0 {
+		if err := result.Timings.WriteJSON(*timingsJSON); err != nil {
+			fmt.Fprintf(os.Stderr, "dex: %v\n", err)
+		}
 	}
 
-	processBlock(block, config)
+	os.Exit(result.Exit)
 }
 
 func initBlockFromPath(dexFile DexFile2, blockPath []string) (Block, error) {
+	return initBlockWithVars(dexFile, blockPath, VarCfgs, nil, ExecConfig{})
+}
+
+/*
+Resolve and initialize a block, adding its variables to varCfgs and then
+the overrides in with.  Used for the block run from the command line and
+for blocks run by other blocks.  Variables from commands run with the
+context and environment of config.
+*/
+func initBlockWithVars(dexFile DexFile2, blockPath []string, varCfgs map[string]VarCfg, with map[string]VarCfg, config ExecConfig) (Block, error) {
 
-	block, err := resolveCmdToCodeblock(dexFile.Blocks, blockPath)
+	chain, err := resolveBlockChain(dexFile.Blocks, blockPath)
 
 	if err != nil {
-		return Block{}, fmt.Errorf("error: No commands were found at %v\n\nSee the menu", blockPath)
+		return Block{}, &BlockNotFoundError{Path: blockPath}
 	}
 
+	/* Platform and environment guards of a block also apply to its children */
+	for _, elem := range chain {
+		if reason := blockGuardReason(elem, config.Env); len(reason) > 0 {
+			return Block{}, &BlockGuardError{Path: blockPath, Reason: reason}
+		}
+	}
+
+	block := chain[len(chain)-1]
+
 	/* Found block.  Init variables, set defaults and process the
 	   block and its commands */
 	checkSetDefault(&block.Shell, dexFile.Shell)
 	checkSetDefault(&block.ShellArgs, dexFile.ShellArgs)
-	initVars(block.Vars)
-	initBlockCommands(&block)
+	initScopeVars(varCfgs, block.Vars, config)
+	maps.Copy(varCfgs, with)
+
+	if ok, err := evalCondition(block.Condition, varCfgs, block.Dir); err != nil {
+		return Block{}, &BlockGuardError{Path: blockPath, Reason: err.Error()}
+	} else if !ok {
+		return Block{}, &BlockGuardError{Path: blockPath, Reason: fmt.Sprintf("condition %q is false", block.Condition)}
+	}
+
+	initBlockCommands(&block, config.Stderr)
 
 	return block, nil
 }
 
+/* Commands built into dex, run with the arguments that follow their name */
+var builtins = map[string]func(dexFile DexFile2, args []string, config ExecConfig) int{
+	"history": runHistory,
+	"status":  runStatus,
+	"watch":   runWatch,
+}
+
+/* Whether there is a top level block by the name */
+func hasBlock(blocks []Block, name string) bool {
+
+	for _, block := range blocks {
+		if block.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* A block path that does not lead to a block */
+type BlockNotFoundError struct {
+	Path []string
+}
+
+func (err *BlockNotFoundError) Error() string {
+	return fmt.Sprintf("error: No commands were found at %v\n\nSee the menu", err.Path)
+}
+
+/* A block that exists but whose guards prevent it from running */
+type BlockGuardError struct {
+	Path   []string
+	Reason string
+}
+
+func (err *BlockGuardError) Error() string {
+	return fmt.Sprintf("error: %v cannot run: %s", err.Path, err.Reason)
+}
+
+/*
+Check the os, arch, requires-env and requires-commands guards of a block.
+Returns why the block cannot run, or an empty string when it can.  The
+condition guard depends on variables and is checked when the block is run.
+Environment variables are looked up in env before the environment of dex.
+*/
+func blockGuardReason(block Block, env []string) string {
+
+	if len(block.OS) > 0 && !slices.Contains(block.OS, runtime.GOOS) {
+		return fmt.Sprintf("requires os %s", strings.Join(block.OS, " or "))
+	}
+
+	if len(block.Arch) > 0 && !slices.Contains(block.Arch, runtime.GOARCH) {
+		return fmt.Sprintf("requires arch %s", strings.Join(block.Arch, " or "))
+	}
+
+	for _, name := range block.RequiresEnv {
+		if _, ok := lookupEnv(env, name); !ok {
+			return fmt.Sprintf("requires environment variable %s", name)
+		}
+	}
+
+	for _, name := range block.RequiresCommands {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Sprintf("requires command %s on PATH", name)
+		}
+	}
+
+	return ""
+}
+
+/* Look up an environment variable in env, the last entry winning, then in the environment of dex */
+func lookupEnv(env []string, name string) (string, bool) {
+
+	for index := len(env) - 1; index >= 0; index-- {
+		if key, value, ok := strings.Cut(env[index], "="); ok && key == name {
+			return value, true
+		}
+	}
+
+	return os.LookupEnv(name)
+}
+
+/* The environment of a command: the environment of dex with env added, or nil for just the former */
+func commandEnv(env []string) []string {
+
+	if len(env) == 0 {
+		return nil
+	}
+
+	return append(os.Environ(), env...)
+}
+
+/* Whether the reader or writer is a terminal */
+func isTerminal(stream any) bool {
+
+	file, ok := stream.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := file.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	/* /dev/null is a character device too */
+	devNull, err := os.Stat(os.DevNull)
+
+	return err != nil || !os.SameFile(info, devNull)
+}
+
+/* Whether the writer is a terminal that will display ANSI colors */
+func useColor(w io.Writer) bool {
+	return isTerminal(w) && os.Getenv("NO_COLOR") == ""
+}
+
 /*
 Display the menu by recursively processing each element of the DexFile and
 showing the name and description for the command.  Children are indented with
-4 spaces.
+4 spaces.  Blocks that cannot run here show the reason, dimmed on a terminal.
 */
 func displayMenu(w io.Writer, blocks []Block, indent int) {
+	displayMenuItems(w, blocks, indent, "", useColor(w))
+}
+
+func displayMenuItems(w io.Writer, blocks []Block, indent int, parentReason string, color bool) {
 	for _, elem := range blocks {
 
-		fmt.Fprintf(w, "%s%-24v: %v\n", strings.Repeat(" ", indent*4), elem.Name, elem.Desc)
+		reason := parentReason
+		if len(reason) == 0 {
+			reason = blockGuardReason(elem, nil)
+		}
+
+		line := fmt.Sprintf("%s%-24v: %v", strings.Repeat(" ", indent*4), elem.Name, elem.Desc)
+
+		if len(reason) > 0 {
+			line += fmt.Sprintf(" (unavailable: %s)", reason)
+
+			if color {
+				line = "\033[2m" + line + "\033[0m"
+			}
+		}
+
+		fmt.Fprintln(w, line)
 
 		if len(elem.Children) >= 1 {
-			displayMenu(w, elem.Children, indent+1)
+			displayMenuItems(w, elem.Children, indent+1, reason, color)
+		}
+	}
+}
+
+/* Return the blocks along a path, from the top level block down to the resolved block */
+func resolveBlockChain(blocks []Block, cmds []string) ([]Block, error) {
+
+	if len(cmds) == 0 {
+		return nil, errors.New("no command given")
+	}
+
+	for _, elem := range blocks {
+		if elem.Name == cmds[0] {
+			if len(cmds) >= 2 {
+				chain, err := resolveBlockChain(elem.Children, cmds[1:])
+				return append([]Block{elem}, chain...), err
+			} else {
+				return []Block{elem}, nil
+			}
 		}
 	}
+	return nil, errors.New("could not find command")
 }
 
 func resolveCmdToCodeblock(blocks []Block, cmds []string) (Block, error) {
@@ -215,19 +822,71 @@ func checkKeys[T VarValue](cfg map[string]any, keys []string) (T, bool) {
 	return empty, false
 }
 
+/*
+Keys that mark a map as a VarCfg rather than a map value.  default, secret
+and the like only apply to these, so maps can still have keys by those names.
+*/
+var varCfgKeys = []string{"from-env", "from_env", "from-command", "from_command", "from-file", "from_file", "value"}
+
+/* A map is a VarCfg when it uses any of the VarCfg keys */
+func isVarCfgMap(valueMap map[string]any) bool {
+
+	for _, key := range varCfgKeys {
+		if _, ok := valueMap[key]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
 func initVars(varMap map[string]any) {
+	initScopeVars(VarCfgs, varMap, ExecConfig{})
+}
+
+/*
+Initialize variables into the scope of a block.  from-env looks at the
+environment of config and from-command runs with its context, while
+problems are reported on its stderr.
+*/
+func initScopeVars(varCfgs map[string]VarCfg, varMap map[string]any, config ExecConfig) {
+
+	stderr := config.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
 	for varName, value := range varMap {
 
-		switch typeVal := value.(type) {
 		/* VarCfg */
-		case map[string]any:
+		if typeVal, ok := value.(map[string]any); ok && isVarCfgMap(typeVal) {
 
 			varCfg := VarCfg{}
 
+			if typeVal["value"] != nil {
+				if valueCfg, err := newVarCfg(typeVal["value"]); err != nil {
+					fmt.Fprintf(stderr, "invalid value for %s: %v\n", varName, err)
+				} else {
+					varCfg = valueCfg
+				}
+			}
+
+			varCfg.Secret, _ = typeVal["secret"].(bool)
+
+			if fromFile, ok := checkKeys[string](typeVal, []string{"from-file", "from_file"}); ok {
+				varCfg.FromFile = fromFile
+
+				if content, err := readVarFile(fromFile, varCfg.Secret, stderr); err != nil {
+					fmt.Fprintf(stderr, "dex: from-file for %s: %v\n", varName, err)
+				} else {
+					SetVarValue(&varCfg, content)
+				}
+			}
+
 			if fromEnv, ok := checkKeys[string](typeVal, []string{"from-env", "from_env"}); ok {
 				varCfg.FromEnv = fromEnv
-				if envVal := os.Getenv(varCfg.FromEnv); len(envVal) > 0 {
-					varCfg.StringValue = envVal
+				if envVal, _ := lookupEnv(config.Env, varCfg.FromEnv); len(envVal) > 0 {
+					SetVarValue(&varCfg, envVal)
 				}
 			}
 
@@ -238,7 +897,19 @@ func initVars(varMap map[string]any) {
 				var output bytes.Buffer
 
 				execConfig := ExecConfig{
-					Stdout: &output,
+					Stdout:   &output,
+					Context:  config.Context,
+					Env:      config.Env,
+					Executor: config.Executor,
+				}
+
+				if timeout, ok := typeVal["timeout"]; ok {
+					if duration, err := parseTimeout(fmt.Sprint(timeout)); err != nil {
+						fmt.Fprintf(stderr, "dex: %s: %v\n", varName, err)
+					} else {
+						varCfg.Timeout = duration
+						execConfig.Timeout = duration
+					}
 				}
 
 				/* TODO? Allow setting custom shell for this.
@@ -249,7 +920,17 @@ func initVars(varMap map[string]any) {
 				execConfig.Cmd = "/bin/bash"
 				execConfig.Args = []string{"-c", varCfg.FromCommand}
 
-				if exit := execCommand(execConfig); exit == 0 {
+				if retry, err := parseRetry(typeVal["retry"]); err != nil {
+					fmt.Fprintf(stderr, "dex: %s: %v\n", varName, err)
+				} else {
+					varCfg.Retry = retry
+				}
+
+				label := fmt.Sprintf("from-command for %s", varName)
+
+				if exit, err := execWithRetry(execConfig, varCfg.Retry, label, output.Reset); err != nil {
+					fmt.Fprintf(stderr, "dex: %s %v\n", label, err)
+				} else if exit == 0 {
 					lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
 
 					/* Turn multi-line output into List */
@@ -262,229 +943,961 @@ func initVars(varMap map[string]any) {
 				}
 			}
 
-			if typeVal["default"] != nil {
-				varCfg.Default = typeVal["default"].(string)
-			}
-
-			if _, err := varCfg.Value(); err != nil && len(varCfg.Default) > 0 {
-
-				SetVarValue(&varCfg, varCfg.Default)
-			}
-
-			VarCfgs[varName] = varCfg
+			varCfg.Default = typeVal["default"]
 
-		/* List */
-		case []any:
+			if _, err := varCfg.Value(); err != nil && varCfg.Default != nil {
 
-			VarCfgs[varName] = VarCfg{
-				ListValue: []string{},
+				if defaultCfg, err := newVarCfg(varCfg.Default); err != nil {
+					fmt.Fprintf(stderr, "invalid default for %s: %v\n", varName, err)
+				} else {
+					defaultCfg.FromCommand = varCfg.FromCommand
+					defaultCfg.FromEnv = varCfg.FromEnv
+					defaultCfg.FromFile = varCfg.FromFile
+					defaultCfg.Default = varCfg.Default
+					defaultCfg.Secret = varCfg.Secret
+					varCfg = defaultCfg
+				}
 			}
 
-			for _, elem := range typeVal {
-
-				entry := VarCfgs[varName]
-				SetVarValue(&entry, append(entry.ListValue, elem.(string)))
-
-				VarCfgs[varName] = entry
+			if varCfg.Secret {
+				config.Secrets.add(varName, varCfg, stderr)
 			}
 
-		/* Integer */
-		case uint64:
-
-			VarCfgs[varName] = VarCfg{
-				StringValue: strconv.FormatUint(typeVal, 10),
-			}
+			varCfgs[varName] = varCfg
 
-		/* String */
-		case string:
+			continue
+		}
 
-			VarCfgs[varName] = VarCfg{
-				StringValue: typeVal,
-			}
-		default:
-			fmt.Printf("I don't know about type %T for %s!\n", typeVal, varName)
+		/* Strings, numbers, booleans, lists and maps */
+		varCfg, err := newVarCfg(value)
+		if err != nil {
+			fmt.Fprintf(stderr, "I don't know about type %T for %s!\n", value, varName)
+			continue
 		}
+
+		varCfgs[varName] = varCfg
 	}
 }
 
 /* Capture the variable name inside the perl template delimiters */
 var fixupRe = regexp.MustCompile(`\[%\s*([^\s%]+)\s*%\]`)
-var tt = template.New("variable_parser")
 
+/*
+Replace the templates in the format established in the perl version with
+the values of the variables.  Variable names may be dotted paths into maps
+and lists, and everything else is left as it is, so commands can use {{ }}
+for tools like docker --format.
+*/
 func render(tmpl string, varCfgs map[string]VarCfg) string {
 
-	if len(tmpl) == 0 {
-		return ""
-	}
-
-	/*
-	   Converting from the template format established in the perl version
-	*/
-	t1, err := tt.Parse(fixupRe.ReplaceAllString(tmpl, "{{ .$1.StringValue }}"))
-	if err != nil {
-		panic(err)
-	}
-
-	var renderBuf bytes.Buffer
-
-	t1.Execute(&renderBuf, varCfgs)
-
-	return renderBuf.String()
+	return fixupRe.ReplaceAllStringFunc(tmpl, func(match string) string {
+		varCfg, _ := lookupVar(varCfgs, fixupRe.FindStringSubmatch(match)[1])
+		return varCfg.String()
+	})
 }
 
 func assignIfSet[T string | []string](commandCfg map[string]any, key string, field *T) {
-	if commandCfg[key] != nil {
-		*field = commandCfg[key].(T)
+	switch value := commandCfg[key].(type) {
+	case nil:
+	case T:
+		*field = value
+	case []any:
+		if list, ok := any(field).(*[]string); ok {
+			*list = []string{}
+
+			for _, elem := range value {
+				*list = append(*list, fmt.Sprint(elem))
+			}
+		}
+	default:
+		/* Scalars like condition: false are used in their string form */
+		if str, ok := any(field).(*string); ok {
+			*str = fmt.Sprint(value)
+		}
+	}
+}
+
+/* Parse the commands of a block, reporting invalid settings on stderr */
+func initBlockCommands(block *Block, stderr io.Writer) {
+
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	if output, err := parseOutput(block.OutputRaw); err != nil {
+		fmt.Fprintf(stderr, "dex: %v\n", err)
+	} else {
+		block.Output = output
+	}
+
+	if container, err := parseContainer(block.ContainerRaw); err != nil {
+		fmt.Fprintf(stderr, "dex: %v\n", err)
+	} else {
+		block.Container = container
 	}
+
+	if remote, err := parseRemote(block.RemoteRaw); err != nil {
+		fmt.Fprintf(stderr, "dex: %v\n", err)
+	} else {
+		block.Remote = remote
+	}
+
+	block.Commands = append(block.Commands, parseCommands(block.CommandsRaw, *block, stderr)...)
+	block.Finally = append(block.Finally, parseCommands(block.FinallyRaw, *block, stderr)...)
+	block.OnFailure = append(block.OnFailure, parseCommands(block.OnFailureRaw, *block, stderr)...)
+
+	block.CommandsRaw = nil
+	block.FinallyRaw = nil
+	block.OnFailureRaw = nil
+	block.OutputRaw = nil
+	block.ContainerRaw = nil
+	block.RemoteRaw = nil
 }
 
-func initBlockCommands(block *Block) {
-	for _, command := range block.CommandsRaw {
+/* Parse a list of commands using the shell of the block by default */
+func parseCommands(commandsRaw []map[string]any, block Block, stderr io.Writer) []Command {
+
+	commands := []Command{}
+
+	for _, command := range commandsRaw {
 
-		/* All this because for-vars can be a string referencing a list or list */
 		Command := Command{}
 
 		assignIfSet(command, "exec", &Command.Exec)
 		assignIfSet(command, "diag", &Command.Diag)
+		assignIfSet(command, "note", &Command.Note)
+		assignIfSet(command, "warn", &Command.Warn)
+		assignIfSet(command, "error", &Command.Error)
 		assignIfSet(command, "dir", &Command.Dir)
 		assignIfSet(command, "condition", &Command.Condition)
+		assignIfSet(command, "condition-shell", &Command.ConditionShell)
+		assignIfSet(command, "condition_shell", &Command.ConditionShell)
+		assignIfSet(command, "only-if", &Command.OnlyIf)
+		assignIfSet(command, "only_if", &Command.OnlyIf)
+		assignIfSet(command, "skip-if", &Command.SkipIf)
+		assignIfSet(command, "skip_if", &Command.SkipIf)
 		assignIfSet(command, "shell", &Command.Shell)
 		assignIfSet(command, "shell_args", &Command.ShellArgs)
 
 		checkSetDefault(&Command.Shell, block.Shell)
 		checkSetDefault(&Command.ShellArgs, block.ShellArgs)
 
-		if command["for-vars"] != nil {
-			switch typeVal := command["for-vars"].(type) {
-			/* inline list */
-			case []any:
+		assignIfSet(command, "for", &Command.For)
+		assignIfSet(command, "timeout", &Command.Timeout)
+		assignIfSet(command, "register", &Command.Register)
+		assignIfSet(command, "register-exit-code", &Command.RegisterExitCode)
 
-				for _, elem := range typeVal {
-					Command.ForVars = append(Command.ForVars, elem.(string))
-				}
-			/* name of list */
-			case string:
-
-				if list := VarCfgs[typeVal]; list.ListValue != nil {
-					Command.ForVars = list.ListValue
-				}
-			default:
-				fmt.Printf("I don't know about type %T in for-vars!\n", typeVal)
+		/* run takes a block path as a string or a list */
+		if path, ok := command["run"].([]any); ok {
+			for _, elem := range path {
+				Command.Run = strings.TrimSpace(Command.Run + " " + fmt.Sprint(elem))
 			}
 		} else {
-			Command.ForVars = []string{"1"}
+			assignIfSet(command, "run", &Command.Run)
+		}
+
+		assignIfSet(command, "script", &Command.Script)
+		assignIfSet(command, "interpreter", &Command.Interpreter)
+		assignIfSet(command, "stdin", &Command.Stdin)
+		assignIfSet(command, "confirm", &Command.Confirm)
+		assignIfSet(command, "confirm-phrase", &Command.ConfirmPhrase)
+
+		if output, err := parseOutput(command["output"]); err != nil {
+			fmt.Fprintf(stderr, "dex: %v\n", err)
+		} else {
+			Command.Output = output
+		}
+
+		if container, err := parseContainer(command["container"]); err != nil {
+			fmt.Fprintf(stderr, "dex: %v\n", err)
+		} else {
+			Command.Container = container
+		}
+
+		if remote, err := parseRemote(command["remote"]); err != nil {
+			fmt.Fprintf(stderr, "dex: %v\n", err)
+		} else {
+			Command.Remote = remote
+		}
+
+		if with, ok := command["with"].(map[string]any); ok {
+			Command.With = with
+		}
+
+		if retry, err := parseRetry(command["retry"]); err != nil {
+			fmt.Fprintf(stderr, "dex: %v\n", err)
+		} else {
+			Command.Retry = retry
 		}
 
-		block.Commands = append(block.Commands, Command)
+		/* for-vars can be a list or a string naming a list, resolved when run */
+		Command.ForVars = command["for-vars"]
+
+		if matrix, ok := command["matrix"].(map[string]any); ok {
+			Command.Matrix = matrix
+		}
+
+		commands = append(commands, Command)
 	}
 
-	block.CommandsRaw = nil
+	return commands
 }
 
 type ExecConfig struct {
-	Cmd    string
-	Args   []string
-	Stdout io.Writer
-	Stderr io.Writer
-	Dir    string
+	Cmd     string
+	Args    []string
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+	Dir     string
+	Verbose bool
+
+	/* Added to the environment of commands and seen by from-env, as KEY=value */
+	Env []string
+
+	/* Local files the command reads, see ExecSpec */
+	Files []string
+
+	/* Silence diag and note, and the --color mode for messages */
+	Quiet bool
+	Color string
+
+	/* Cancellation, timeout and the grace period before SIGKILL.  Cleanup
+	   is used by finally and on-failure commands, which still run after
+	   Context is cancelled */
+	Context     context.Context
+	Cleanup     context.Context
+	Timeout     time.Duration
+	GracePeriod time.Duration
+
+	/* Variables for rendering commands, VarCfgs when unset */
+	Vars map[string]VarCfg
+
+	/* The DexFile for run commands, and the blocks running them */
+	File  *DexFile2
+	Calls []string
+
+	/* The shell of a block with session: true */
+	Session *shellSession
+
+	/* Runs the commands, a LocalExecutor when nil */
+	Executor Executor
+
+	/* The execution log and the path of the block being run */
+	Logger *ExecLogger
+	Path   []string
+
+	/* Timings of the blocks and commands for --timings */
+	Timings *TimingReport
+
+	/* Files the output of commands is written to, and whether Stdout is
+	   one of them, which diag and note then go to as well */
+	Outputs    *outputFiles
+	OutputFile bool
+
+	/* Where the fingerprints of blocks with sources are kept, and whether
+	   to run blocks that are up to date anyway */
+	StateDir string
+	Force    bool
+
+	/* Give commands the terminal on stdin, see ExecSpec */
+	Foreground bool
+
+	/* Where the run started, before blocks changed to their dir */
+	BaseDir string
+
+	/* Values of the secret variables of the run, see secretValues */
+	Secrets *secretValues
+
+	/* Where confirm prompts read the answer, declined when nil, and
+	   whether to answer yes without asking, for --yes */
+	Prompt io.Reader
+	Yes    bool
 }
 
-func processBlock(block Block, config ExecConfig) {
+/*
+Run the commands of a block and return the exit code for dex: the code of
+the last command that failed, or the code for a timeout or interrupt.
+*/
+func processBlock(block Block, config ExecConfig) (status int) {
+
+	start := time.Now()
+	timed := config.Timings.startBlock(config.Secrets.redactPath(config.Path))
 
-	if len(block.Dir) > 0 {
-		config.Dir = block.Dir
-	} else {
+	defer func() {
+		config.Logger.logBlock(config, start, status)
+		timed(status)
+	}()
+
+	if len(config.Dir) == 0 {
 		dir, err := os.Getwd()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "cannot get current working directory \n")
-			return
+			fmt.Fprintf(config.Stderr, "cannot get current working directory \n")
+			return 1
 		} else {
 			config.Dir = dir
 		}
 	}
 
-	runCommandsWithConfig(block.Commands, config)
+	checkSetDefault(&config.BaseDir, config.Dir)
+	checkSetOverride(&config.Dir, block.Dir)
+
+	scope := config.Vars
+	if scope == nil {
+		scope = VarCfgs
+	}
+
+	timeout, err := parseTimeout(render(block.Timeout, scope))
+	if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+		return 1
+	}
+
+	if config.Context == nil {
+		config.Context = context.Background()
+	}
+
+	ctx, cancel := withTimeout(config.Context, timeout)
+	defer cancel()
+
+	config.Context = ctx
+
+	/* Blocks with sources only run when something changed */
+	if len(block.Sources) > 0 && len(config.StateDir) > 0 {
+		reason, fingerprint := staleReason(block, scope, config.Dir, config.StateDir, config.Path)
+
+		if len(reason) == 0 && !config.Force {
+			fmt.Fprintf(config.Stderr, "dex: %v is up to date\n", config.Secrets.redactPath(config.Path))
+			return 0
+		} else if config.Verbose && len(reason) > 0 {
+			fmt.Fprintf(config.Stderr, "dex: running %v: %s\n", config.Secrets.redactPath(config.Path), reason)
+		}
+
+		defer func() {
+			if status != 0 || len(fingerprint) == 0 {
+				return
+			}
+
+			if err := writeState(config.StateDir, config.Path, fingerprint); err != nil {
+				fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+			}
+		}()
+	}
+
+	if len(block.Confirm) > 0 {
+		if !confirm(render(block.Confirm, scope), render(block.ConfirmPhrase, scope), confirmPlan(block.Commands, scope), config) {
+			return 1
+		}
+	}
+
+	/* Output files stay open while the block runs, and are left alone by a
+	   dry run, which blocks it runs inherit even when they pick executors */
+	if block.Output.IsSet() || config.Outputs == nil {
+		_, dryRun := config.Executor.(*RecordingExecutor)
+		dryRun = dryRun || (config.Outputs != nil && config.Outputs.discard)
+
+		config.Outputs = &outputFiles{discard: dryRun}
+		defer config.Outputs.close()
+	}
+
+	if len(block.Executor) > 0 {
+		executor, err := lookupExecutor(block.Executor)
+		if err != nil {
+			fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+			return 1
+		}
+
+		/* A dry run records the commands whatever executor the block picks */
+		if _, dryRun := config.Executor.(*RecordingExecutor); !dryRun {
+			config.Executor = executor
+		}
+	}
+
+	if block.Remote.IsSet() {
+		config.Executor = block.Remote.executor(scope, config.BaseDir, config.Executor)
+	}
+
+	if block.Container.IsSet() {
+		config.Executor = block.Container.executor(scope, config.BaseDir, config.Executor)
+	}
+
+	/* Sessions keep a local shell, other executors run every command themselves */
+	if _, local := config.Executor.(LocalExecutor); block.Session && (config.Executor == nil || local) {
+		session := &shellSession{Shell: block.Shell, Stderr: config.Stderr, Env: config.Env}
+		defer session.close()
+
+		config.Session = session
+	}
+
+	/* Cleanup outlives the block timeout and the first interrupt */
+	if config.Cleanup == nil {
+		config.Cleanup = context.WithoutCancel(ctx)
+	}
+
+	iterations, err := block.Iterations(scope)
+	if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+		return 1
+	}
+
+	/* Block loops run the whole list of commands for each iteration */
+	for _, iteration := range iterations {
+
+		iterationConfig := config
+		iterationConfig.Vars = map[string]VarCfg{}
+
+		maps.Copy(iterationConfig.Vars, scope)
+		maps.Copy(iterationConfig.Vars, iteration)
+
+		iterationConfig, err = block.Output.apply(iterationConfig.Vars, iterationConfig)
+		if err != nil {
+			fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+			status = 1
+			continue
+		}
+
+		result := runCommandsWithConfig(block.Commands, iterationConfig)
+
+		if exit := runCleanup(block, iterationConfig, result); exit != 0 {
+			status = exit
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return status
+}
+
+/*
+Run the on-failure commands when the block failed and then the finally
+commands.  They see the variables of the block, including registered ones,
+with the exit code in exit_code and the failing command in failed_command.
+Returns the exit code of the block, or of the cleanup when only it failed.
+*/
+func runCleanup(block Block, config ExecConfig, result commandsResult) int {
+
+	if len(block.OnFailure) == 0 && len(block.Finally) == 0 {
+		return result.Status
+	}
+
+	config.Context = config.Cleanup
+	config.Vars = maps.Clone(result.Vars)
+	config.Vars["exit_code"] = VarCfg{Type: IntVar, IntValue: int64(result.Status)}
+
+	/* The failed command is a label dex made, with the secrets redacted */
+	config.Vars["failed_command"] = VarCfg{Type: StringVar, StringValue: config.Secrets.redact(result.Failed)}
+
+	status := result.Status
+
+	if result.Status != 0 && len(block.OnFailure) > 0 {
+		if cleanup := runCommandsWithConfig(block.OnFailure, config); status == 0 {
+			status = cleanup.Status
+		}
+	}
+
+	if len(block.Finally) > 0 {
+		if cleanup := runCommandsWithConfig(block.Finally, config); status == 0 {
+			status = cleanup.Status
+		}
+	}
+
+	return status
+}
+
+/* Outcome of running a list of commands */
+type commandsResult struct {
+	/* Exit code of the last command that failed, or 0 */
+	Status int
+
+	/* The rendered command that set Status */
+	Failed string
+
+	/* Variables after the commands ran, including registered ones */
+	Vars map[string]VarCfg
 }
 
-func runCommandsWithConfig(commands []Command, config ExecConfig) {
+/*
+Run the commands and return the exit code of the last one that failed.  A
+timeout or interrupt stops the remaining commands and returns its code.
+*/
+func runCommandsWithConfig(commands []Command, config ExecConfig) commandsResult {
 
 	cwd := config.Dir
+	status := 0
+	failed := ""
+
+	/* Only plain exec commands run in the session */
+	session := config.Session
+	config.Session = nil
+
+	/* Registered variables are only visible to the following commands */
+	scope := maps.Clone(config.Vars)
+	if scope == nil {
+		scope = maps.Clone(VarCfgs)
+	}
 
 	for _, command := range commands {
 
-		if exit := checkCommandCondition(command.Condition, VarCfgs); exit != 0 {
+		dir := cwd
+		checkSetOverride(&dir, render(command.Dir, scope))
+
+		iterations, err := command.Iterations(scope)
+		if err != nil {
+			fmt.Fprintf(config.Stderr, "dex: %v\n", err)
 			continue
 		}
 
 		execConfig := config
+		execConfig.Dir = dir
 
-		/* Update cwd so that the directory update is
-		   preserved until another command changes it */
-		checkSetOverride(&cwd, render(command.Dir, VarCfgs))
+		skipped := []string{}
+		registered := []VarCfg{}
+		exitCodes := []VarCfg{}
 
-		execConfig.Dir = cwd
 		/* This behaves slightly different from the perl version
 		   1. Diag wont override Exec and both can run if both are defined
 		   2. Diag and Exec will both be looped with for-vars
+		   3. Conditions are checked for each iteration of the loop
 		*/
-		for index, value := range command.ForVars {
+		for index, iteration := range iterations {
 
 			varCfgs := map[string]VarCfg{}
 
-			maps.Copy(varCfgs, VarCfgs)
-			maps.Copy(varCfgs, map[string]VarCfg{"index": {StringValue: strconv.Itoa(index)}, "var": {StringValue: value}})
+			maps.Copy(varCfgs, scope)
+			maps.Copy(varCfgs, iteration)
+
+			/* A command with a host or container runs there, its conditions too */
+			executor := config.Executor
+			if command.Remote.IsSet() {
+				executor = command.Remote.executor(varCfgs, config.BaseDir, executor)
+			}
+
+			if command.Container.IsSet() {
+				executor = command.Container.executor(varCfgs, config.BaseDir, executor)
+			}
+
+			conditionConfig := config
+			conditionConfig.Dir = dir
+			conditionConfig.Executor = executor
+
+			if ok, err := checkCommandCondition(command, varCfgs, conditionConfig); err != nil || !ok {
+				if exit := cancelExitCodeFor(config.Context); exit != 0 {
+					fmt.Fprintf(config.Stderr, "dex: %v\n", context.Cause(config.Context))
+					return commandsResult{Status: exit, Failed: render(command.Exec, varCfgs), Vars: scope}
+				} else if err != nil {
+					fmt.Fprintf(config.Stderr, "dex: %v\n", config.Secrets.redact(err.Error()))
+				}
+
+				skipped = append(skipped, fmt.Sprintf("index %d (%s)", index, describeIteration(iteration)))
+				config.Timings.skipped(config.Secrets.redactPath(config.Path), config.Secrets.redact(commandLabel(command, varCfgs)))
+				continue
+			}
+
+			/* Update cwd so that the directory update is
+			   preserved until another command changes it */
+			cwd = dir
 
-			if len(command.Diag) > 0 {
-				execConfig.Cmd = "/usr/bin/echo"
-				execConfig.Args = []string{render(command.Diag, varCfgs)}
+			if len(command.Confirm) > 0 {
+				question := render(command.Confirm, varCfgs)
 
-				execCommand(execConfig)
+				if !confirm(question, render(command.ConfirmPhrase, varCfgs), []string{commandLabel(command, varCfgs)}, config) {
+					return commandsResult{Status: 1, Failed: commandLabel(command, varCfgs), Vars: scope}
+				}
+			}
+
+			timeout, err := parseTimeout(render(command.Timeout, varCfgs))
+			if err != nil {
+				fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+				status, failed = 1, render(command.Exec, varCfgs)
+				continue
 			}
 
-			if len(command.Exec) > 0 {
+			execConfig.Timeout = timeout
+
+			execConfig.Stdout, execConfig.Stderr = config.Stdout, config.Stderr
+
+			if execConfig, err = command.Output.apply(varCfgs, execConfig); err != nil {
+				fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+				status, failed = 1, commandLabel(command, varCfgs)
+				continue
+			}
+
+			execConfig.Executor = executor
+			execConfig.Files = nil
+
+			writeDiags(command, varCfgs, execConfig)
+
+			if len(command.Exec) > 0 || len(command.Script) > 0 {
+				rendered := render(command.Exec, varCfgs)
+
 				execConfig.Cmd = command.Shell
 				execConfig.Args = command.ShellArgs
-				execConfig.Args = append(execConfig.Args, render(command.Exec, varCfgs))
+				execConfig.Args = append(execConfig.Args, rendered)
+
+				/* What dex says about the command has its secrets redacted */
+				rendered = config.Secrets.redact(rendered)
+
+				/* A script is written to a file instead of passed with -c */
+				remove := func() {}
+
+				if len(command.Exec) == 0 {
+					script := render(command.Script, varCfgs)
+					rendered = config.Secrets.redact(scriptLabel(script))
+
+					if remove, err = prepareScript(command, script, varCfgs, &execConfig); err != nil {
+						fmt.Fprintf(config.Stderr, "dex: %v: %s\n", err, rendered)
+						status, failed = 1, rendered
+						continue
+					}
+				}
+
+				if len(command.Stdin) > 0 {
+					execConfig.Stdin = strings.NewReader(render(command.Stdin, varCfgs))
+				}
+
+				/* Registered output is captured instead of shown, from the last attempt */
+				var captured bytes.Buffer
+				var reset func()
+
+				stdout := execConfig.Stdout
+
+				if len(command.Register) > 0 {
+					execConfig.Stdout = &captured
+					reset = captured.Reset
+				}
+
+				if session != nil && len(command.Exec) > 0 && len(command.Stdin) == 0 && command.Shell == session.Shell {
+					execConfig.Session = session
+
+					/* A command with a dir goes there even when it is where the shell was sent last */
+					if len(command.Dir) > 0 {
+						session.dir = ""
+					}
+				}
+
+				started := time.Now()
+
+				exit, err := execWithRetry(execConfig, command.Retry, rendered, reset)
+
+				config.Logger.logCommand(execConfig, rendered, started, exit)
+				config.Timings.command(config.Secrets.redactPath(config.Path), rendered, started, exit)
+
+				remove()
+
+				execConfig.Session = nil
+
+				execConfig.Stdout = stdout
+				execConfig.Stdin = config.Stdin
+
+				if err != nil {
+					fmt.Fprintf(config.Stderr, "dex: %v: %s\n", err, rendered)
+					return commandsResult{Status: exit, Failed: rendered, Vars: scope}
+				}
+
+				registered = append(registered, VarCfg{Type: StringVar, StringValue: strings.TrimSpace(captured.String())})
+				exitCodes = append(exitCodes, VarCfg{Type: IntVar, IntValue: int64(exit)})
+
+				/* A registered exit code is for later commands to check */
+				if exit != 0 && len(command.RegisterExitCode) == 0 {
+					status, failed = exit, rendered
+				}
+			}
+
+			if len(command.Run) > 0 {
+				rendered := render(command.Run, varCfgs)
 
-				execCommand(execConfig)
+				if exit := runBlock(rendered, command.With, varCfgs, execConfig); exit != 0 {
+					status, failed = exit, config.Secrets.redact("run "+rendered)
+
+					if cancelExitCodeFor(config.Context) != 0 {
+						return commandsResult{Status: exit, Failed: failed, Vars: scope}
+					}
+				}
 			}
 		}
+
+		registerVar(scope, command.Register, registered, command.IsSet())
+		registerVar(scope, command.RegisterExitCode, exitCodes, command.IsSet())
+
+		if config.Verbose && len(skipped) > 0 {
+			reportSkipped(config.Stderr, command, skipped, len(iterations), config.Secrets)
+		}
 	}
+
+	return commandsResult{Status: status, Failed: failed, Vars: scope}
 }
 
-func execCommand(config ExecConfig) int {
+/*
+Run another block of the DexFile by its path, like it was run from the
+command line.  The block sees the variables of the calling command, its
+own variables and then those in with.  Returns the exit code of the block.
+*/
+func runBlock(path string, with map[string]any, varCfgs map[string]VarCfg, config ExecConfig) int {
 
-	cmd := exec.Command(config.Cmd, config.Args...)
-	cmd.Stdout = config.Stdout
-	cmd.Stderr = config.Stderr
-	cmd.Dir = config.Dir
+	if config.File == nil {
+		fmt.Fprintf(config.Stderr, "dex: cannot run %s without a DexFile\n", path)
+		return 1
+	}
 
-	err := cmd.Run()
-	if err != nil {
+	blockPath := strings.Fields(path)
+	if len(blockPath) == 0 {
+		fmt.Fprintf(config.Stderr, "dex: run needs a block path\n")
+		return 1
+	}
 
-		if exitError, ok := err.(*exec.ExitError); ok {
-			return exitError.ExitCode()
-		} else {
+	calls := append(slices.Clone(config.Calls), strings.Join(blockPath, " "))
+
+	if slices.Contains(config.Calls, calls[len(calls)-1]) {
+		fmt.Fprintf(config.Stderr, "dex: recursive run of %v: %s\n", config.Secrets.redactPath(blockPath), config.Secrets.redact(strings.Join(calls, " -> ")))
+		return 1
+	}
+
+	overrides := map[string]VarCfg{}
+
+	for name, value := range with {
+		varCfg, err := newVarCfg(value)
+		if err != nil {
+			fmt.Fprintf(config.Stderr, "dex: invalid with value for %s: %v\n", name, err)
 			return 1
 		}
+
+		if varCfg.Type == StringVar {
+			varCfg.StringValue = render(varCfg.StringValue, varCfgs)
+		}
+
+		overrides[name] = varCfg
+	}
+
+	scope := maps.Clone(varCfgs)
+
+	block, err := initBlockWithVars(*config.File, blockPath, scope, overrides, config)
+
+	var guardErr *BlockGuardError
+	if errors.As(err, &guardErr) {
+		fmt.Fprintf(config.Stderr, "dex: cannot run %v: %s\n", config.Secrets.redactPath(blockPath), config.Secrets.redact(guardErr.Reason))
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: cannot run %v: no such block\n", config.Secrets.redactPath(blockPath))
+		return 1
+	}
+
+	config.Vars = scope
+	config.Calls = calls
+	config.Path = blockPath
+
+	return processBlock(block, config)
+}
+
+/* Describe a command for messages and reports */
+func commandLabel(command Command, varCfgs map[string]VarCfg) string {
+
+	switch {
+	case len(command.Exec) > 0:
+		return render(command.Exec, varCfgs)
+	case len(command.Script) > 0:
+		return scriptLabel(render(command.Script, varCfgs))
+	case len(command.Run) > 0:
+		return "run " + render(command.Run, varCfgs)
+	default:
+		return render(command.Diag, varCfgs)
+	}
+}
+
+/*
+Add a registered value to the scope of the block.  Loops register a list
+with the value of each iteration that ran.
+*/
+func registerVar(scope map[string]VarCfg, name string, values []VarCfg, loop bool) {
+
+	if len(name) == 0 {
+		return
 	}
 
-	return 0
+	if loop {
+		scope[name] = VarCfg{Type: ListVar, ListValue: values}
+	} else if len(values) == 1 {
+		scope[name] = values[0]
+	}
 }
 
-func checkCommandCondition(condition string, varCfgs map[string]VarCfg) int {
+/* The exit code for a cancelled context, or 0 when it is still running */
+func cancelExitCodeFor(ctx context.Context) int {
 
-	if len(condition) == 0 {
+	if ctx == nil || ctx.Err() == nil {
 		return 0
 	}
 
-	config := ExecConfig{
-		Stdout: os.NewFile(0, os.DevNull),
-		Stderr: os.NewFile(0, os.DevNull),
+	return cancelExitCode(context.Cause(ctx))
+}
+
+/* Summarize the iterations of a command that were skipped by its conditions */
+func reportSkipped(w io.Writer, command Command, skipped []string, total int, secrets *secretValues) {
+
+	label := command.Exec
+	checkSetDefault(&label, command.Diag)
+
+	if !command.IsSet() {
+		fmt.Fprintf(w, "dex: skipped %q\n", secrets.redact(label))
+		return
+	}
+
+	fmt.Fprintf(w, "dex: skipped %d of %d iterations of %q: %s\n",
+		len(skipped), total, secrets.redact(label), secrets.redact(strings.Join(skipped, ", ")))
+}
+
+/* Exit code used when a timeout fires, the same as timeout(1) */
+const ExitTimeout = 124
+
+/* Time commands get to exit after being signalled before they are killed */
+var DefaultGracePeriod = 5 * time.Second
+
+/* Returned when a command is stopped by a timeout */
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v", err.Timeout)
+}
+
+/* Returned when a command is stopped because dex received a signal */
+type InterruptError struct {
+	Signal os.Signal
+}
+
+func (err *InterruptError) Error() string {
+	return fmt.Sprintf("interrupted by %v", err.Signal)
+}
+
+/* The exit code dex uses for a timeout or interrupt */
+func cancelExitCode(err error) int {
+
+	var timeoutErr *TimeoutError
+	var interruptErr *InterruptError
+
+	if errors.As(err, &timeoutErr) {
+		return ExitTimeout
+	} else if errors.As(err, &interruptErr) {
+		return signalExitCode(interruptErr.Signal)
+	}
+
+	return 1
+}
+
+/* Parse a timeout given as a duration like 1m30s or a number of seconds */
+func parseTimeout(timeout string) (time.Duration, error) {
+
+	if len(timeout) == 0 {
+		return 0, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(timeout, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", timeout)
+	}
+
+	return duration, nil
+}
+
+/* Limit the context to the timeout, if there is one */
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, timeout, &TimeoutError{Timeout: timeout})
+}
+
+/* The context commands run in, one that is never done when none is configured */
+func execContext(config ExecConfig) context.Context {
+
+	if config.Context == nil {
+		return context.Background()
+	}
+
+	return config.Context
+}
+
+/*
+Run a command and return its exit code.  The error is only set when the
+command was stopped by a timeout or interrupt, and the exit code is then
+ExitTimeout or 128 plus the signal number.
+*/
+func execCommand(config ExecConfig) (int, error) {
+
+	if config.Session != nil {
+		return config.Session.run(config)
+	}
+
+	executor := config.Executor
+	if executor == nil {
+		executor = LocalExecutor{}
+	}
+
+	ctx, cancel := withTimeout(execContext(config), config.Timeout)
+	defer cancel()
+
+	result := executor.Run(ctx, ExecSpec{
+		Cmd:         config.Cmd,
+		Args:        config.Args,
+		Dir:         config.Dir,
+		Env:         config.Env,
+		Stdin:       config.Stdin,
+		Stdout:      config.Stdout,
+		Stderr:      config.Stderr,
+		Files:       config.Files,
+		GracePeriod: config.GracePeriod,
+		Foreground:  config.Foreground,
+		Redact:      config.Secrets.redact,
+	})
+
+	return result.Exit, result.Err
+}
+
+/*
+Check the conditions of a command: condition and only-if must be true,
+skip-if must be false and the test style condition-shell must pass.
+*/
+func checkCommandCondition(command Command, varCfgs map[string]VarCfg, config ExecConfig) (bool, error) {
+
+	dir := config.Dir
+
+	for _, condition := range []string{command.Condition, command.OnlyIf} {
+		if ok, err := evalCondition(condition, varCfgs, dir); !ok || err != nil {
+			return false, err
+		}
+	}
+
+	if len(strings.TrimSpace(command.SkipIf)) > 0 {
+		if skip, err := evalCondition(command.SkipIf, varCfgs, dir); skip || err != nil {
+			return false, err
+		}
+	}
+
+	if len(command.ConditionShell) == 0 {
+		return true, nil
+	}
+
+	config = ExecConfig{
+		Stdout:   io.Discard,
+		Stderr:   io.Discard,
+		Dir:      dir,
+		Context:  config.Context,
+		Env:      config.Env,
+		Executor: config.Executor,
 	}
 
 	config.Cmd = "/bin/bash"
-	config.Args = []string{"-c", fmt.Sprintf("test %s", render(condition, varCfgs))}
+	config.Args = []string{"-c", fmt.Sprintf("test %s", render(command.ConditionShell, varCfgs))}
+
+	exit, err := execCommand(config)
 
-	return execCommand(config)
+	return exit == 0 && err == nil, err
 }
@@ -6,7 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -338,15 +341,18 @@ blocks:
 			CommandOut: "hello world\n",
 			ExpectedVars: map[string]VarCfg{
 				"string_var": {
+					Type:        StringVar,
 					StringValue: "hi there",
 				},
 				"int_var": {
-					StringValue: "2",
+					Type:     IntVar,
+					IntValue: 2,
 				},
 				"list_var": {
-					ListValue: []string{
-						"these",
-						"those",
+					Type: ListVar,
+					ListValue: []VarCfg{
+						{Type: StringVar, StringValue: "these"},
+						{Type: StringVar, StringValue: "those"},
 					},
 				},
 			},
@@ -379,18 +385,22 @@ blocks:
 			CommandOut: "hello world\n",
 			ExpectedVars: map[string]VarCfg{
 				"global_string": {
+					Type:        StringVar,
 					StringValue: "foobar",
 				},
 				"string_var": {
+					Type:        StringVar,
 					StringValue: "from block",
 				},
 				"int_var": {
-					StringValue: "3",
+					Type:     IntVar,
+					IntValue: 3,
 				},
 				"list_var": {
-					ListValue: []string{
-						"one",
-						"two",
+					Type: ListVar,
+					ListValue: []VarCfg{
+						{Type: StringVar, StringValue: "one"},
+						{Type: StringVar, StringValue: "two"},
 					},
 				},
 			},
@@ -413,10 +423,12 @@ blocks:
 			BlockPath: []string{"block_vars"},
 			ExpectedVars: map[string]VarCfg{
 				"global_string": {
+					Type:        StringVar,
 					FromEnv:     "TESTENV",
 					StringValue: "from env!",
 				},
 				"not_set": {
+					Type:        StringVar,
 					FromEnv:     "TESTENV_UNSET",
 					Default:     "fizzbizz",
 					StringValue: "fizzbizz",
@@ -440,12 +452,83 @@ blocks:
 			BlockPath: []string{"block_vars"},
 			ExpectedVars: map[string]VarCfg{
 				"command_string": {
+					Type:        StringVar,
 					FromCommand: "echo \"c var\"",
 					StringValue: "c var",
 				},
 				"command_list": {
+					Type:        ListVar,
 					FromCommand: "echo -en \"foo\\nbar\\nbazz\"",
-					ListValue:   []string{"foo", "bar", "bazz"},
+					ListValue: []VarCfg{
+						{Type: StringVar, StringValue: "foo"},
+						{Type: StringVar, StringValue: "bar"},
+						{Type: StringVar, StringValue: "bazz"},
+					},
+				},
+			},
+		},
+		{
+			Name: "Typed Vars",
+			Config: `---
+version: 2
+vars:
+  enabled: true
+  offset: -3
+  ratio: 2.5
+  mixed_list:
+    - foo
+    - 34
+    - false
+  nested_list:
+    - [a, b]
+  db:
+    host: localhost
+    port: 5432
+  fallback:
+    from-env: TESTENV_UNSET
+    default: 0
+
+blocks:
+  - name: block_vars
+    desc: this is a command description
+`,
+			BlockPath: []string{"block_vars"},
+			ExpectedVars: map[string]VarCfg{
+				"enabled": {Type: BoolVar, BoolValue: true},
+				"offset":  {Type: IntVar, IntValue: -3},
+				"ratio":   {Type: FloatVar, FloatValue: 2.5},
+				"mixed_list": {
+					Type: ListVar,
+					ListValue: []VarCfg{
+						{Type: StringVar, StringValue: "foo"},
+						{Type: IntVar, IntValue: 34},
+						{Type: BoolVar, BoolValue: false},
+					},
+				},
+				"nested_list": {
+					Type: ListVar,
+					ListValue: []VarCfg{
+						{
+							Type: ListVar,
+							ListValue: []VarCfg{
+								{Type: StringVar, StringValue: "a"},
+								{Type: StringVar, StringValue: "b"},
+							},
+						},
+					},
+				},
+				"db": {
+					Type: MapVar,
+					MapValue: map[string]VarCfg{
+						"host": {Type: StringVar, StringValue: "localhost"},
+						"port": {Type: IntVar, IntValue: 5432},
+					},
+				},
+				"fallback": {
+					Type:     IntVar,
+					IntValue: 0,
+					FromEnv:  "TESTENV_UNSET",
+					Default:  uint64(0),
 				},
 			},
 		},
@@ -523,6 +606,65 @@ blocks:
 			BlockPath:  []string{"diag_command"},
 			CommandOut: "foobar from block 4\n",
 		},
+		{
+			Name: "Typed Vars",
+			Config: `---
+version: 2
+vars:
+  hosts:
+    - web1
+    - web2
+  db:
+    host: localhost
+    port: 5432
+    replicas:
+      - host: replica1
+  ratio: 0.5
+  debug: false
+
+blocks:
+  - name: typed_vars
+    desc: this is a command description
+    commands:
+       - exec: echo "[% db.host %]:[% db.port %] [% hosts.1 %] [% db.replicas.0.host %]"
+       - exec: echo "[% hosts %] [% ratio %] [% debug %] [% db.missing %]"
+`,
+			BlockPath:  []string{"typed_vars"},
+			CommandOut: "localhost:5432 web2 replica1\nweb1 web2 0.5 false \n",
+		},
+		{
+			Name: "Go template delimiters",
+			Config: `---
+version: 2
+vars:
+  format: "{{ .Names }}"
+blocks:
+  - name: braces
+    desc: this is a command description
+    commands:
+       - exec: echo '{{' "[% format %]" '{{ .ID }}'
+`,
+			BlockPath:  []string{"braces"},
+			CommandOut: "{{ {{ .Names }} {{ .ID }}\n",
+		},
+		{
+			Name: "Maps with option names",
+			Config: `---
+version: 2
+vars:
+  db:
+    host: localhost
+    default: true
+    secret: vault
+blocks:
+  - name: map_vars
+    desc: this is a command description
+    commands:
+       - exec: echo "[% db.host %] [% db.default %] [% db.secret %]"
+`,
+			BlockPath:  []string{"map_vars"},
+			CommandOut: "localhost true vault\n",
+		},
 	}
 
 	for _, test := range tests {
@@ -651,6 +793,30 @@ blocks:
 			BlockPath:  []string{"loop_vars"},
 			CommandOut: "0 one\n1 two\n2 three\n",
 		},
+		{
+			Name: "for-vars typed list",
+			Config: `---
+version: 2
+vars:
+  servers:
+    - name: alpha
+      port: 80
+    - name: beta
+      port: 8080
+blocks:
+  - name: loop_vars
+    desc: this is a command description
+    commands:
+      - exec: echo [% index %] [% var.name %] [% var.port %]
+        for-vars: servers
+      - exec: echo [% var %]
+        for-vars:
+          - 1
+          - true
+`,
+			BlockPath:  []string{"loop_vars"},
+			CommandOut: "0 alpha 80\n1 beta 8080\n1\ntrue\n",
+		},
 		{
 			Name: "for-vars list ref",
 			Config: `---
@@ -711,9 +877,9 @@ blocks:
     desc: this is a command description
     commands: 
       - exec: echo condition true 
-        condition: 1 -eq 1 
+        condition-shell: 1 -eq 1 
       - exec: echo condition false 
-        condition: 1 -eq 0 
+        condition-shell: 1 -eq 0 
 
 `,
 			BlockPath:  []string{"condition commands"},
@@ -731,11 +897,78 @@ blocks:
     desc: this is a command description
     commands: 
       - exec: echo condition true 
-        condition: 1 -eq [% conditionVal %] 
+        condition: 1 == [% conditionVal %] 
 `,
 			BlockPath:  []string{"condition commands"},
 			CommandOut: "condition true\n",
 		},
+		{
+			Name: "typed conditions",
+			Config: `---
+version: 2
+vars:
+  retries: 3
+  enabled: true
+  ratio: 0.5
+blocks:
+  - name: condition commands
+    desc: this is a command description
+    commands:
+      - exec: echo retries
+        condition: retries > 2
+      - exec: echo enabled
+        condition: enabled == true
+      - exec: echo ratio
+        condition: ratio == 1.5
+`,
+			BlockPath:  []string{"condition commands"},
+			CommandOut: "retries\nenabled\n",
+		},
+		{
+			Name: "native conditions",
+			Config: `---
+version: 2
+vars:
+  env: prod
+  hosts: [web1, web2]
+blocks:
+  - name: condition commands
+    desc: this is a command description
+    commands:
+      - exec: echo in list
+        condition: '"web2" in hosts && env != "dev"'
+      - exec: echo not defined
+        condition: '!defined(missing) || false'
+      - exec: echo matches
+        condition: env matches "^pr"
+      - exec: echo template
+        condition: '"[% env %]" == "prod"'
+      - exec: echo invalid
+        condition: env ==
+      - exec: echo shell and native
+        condition: defined(env)
+        condition-shell: 1 -eq 0
+`,
+			BlockPath:  []string{"condition commands"},
+			CommandOut: "in list\nnot defined\nmatches\ntemplate\ndex: invalid condition \"env ==\": unexpected end of expression\n",
+		},
+		{
+			Name: "unquoted template conditions",
+			Config: `---
+version: 2
+vars:
+  env: prod
+blocks:
+  - name: condition commands
+    desc: this is a command description
+    commands:
+      - exec: echo deploying to staging
+        condition: "[% env %] == staging"
+      - exec: echo done
+`,
+			BlockPath:  []string{"condition commands"},
+			CommandOut: "dex: condition \"[% env %] == staging\": undefined variable prod, quote it to use it as a string\ndone\n",
+		},
 	}
 
 	for _, test := range tests {
@@ -760,3 +993,818 @@ blocks:
 		assert.Equal(t, test.CommandOut, output.String())
 	}
 }
+
+func TestBlockGuards(t *testing.T) {
+
+	config := `---
+version: 2
+vars:
+  stage: dev
+blocks:
+  - name: anywhere
+    desc: runs everywhere
+    requires-commands: [sh]
+    commands:
+      - exec: echo anywhere
+  - name: other os
+    desc: wrong os
+    os: [plan9]
+    children:
+      - name: child
+        desc: inherits the guard
+  - name: needs env
+    desc: needs an env var
+    requires-env: [DEX_TEST_UNSET_ENV]
+  - name: needs command
+    desc: needs a command
+    requires-commands: [dex-test-no-such-command]
+  - name: prod only
+    desc: gated by a condition
+    condition: stage == "prod"
+  - name: block vars
+    desc: condition on block vars
+    vars:
+      enabled: true
+    condition: enabled && arch == "` + runtime.GOARCH + `"
+`
+
+	tcfg, yamlData, _ := createTestConfig(t, config)
+
+	defer os.Remove(tcfg.Name())
+
+	dexFile, err := ParseConfig(yamlData)
+	check(t, err, "Error parsing config")
+
+	var output bytes.Buffer
+	displayMenu(&output, dexFile.Blocks, 0)
+
+	assert.Equal(t, `anywhere                : runs everywhere
+other os                : wrong os (unavailable: requires os plan9)
+    child                   : inherits the guard (unavailable: requires os plan9)
+needs env               : needs an env var (unavailable: requires environment variable DEX_TEST_UNSET_ENV)
+needs command           : needs a command (unavailable: requires command dex-test-no-such-command on PATH)
+prod only               : gated by a condition
+block vars              : condition on block vars
+`, output.String())
+
+	tests := []struct {
+		BlockPath []string
+		Reason    string
+	}{
+		{BlockPath: []string{"anywhere"}},
+		{BlockPath: []string{"block vars"}},
+		{BlockPath: []string{"other os", "child"}, Reason: "requires os plan9"},
+		{BlockPath: []string{"needs env"}, Reason: "requires environment variable DEX_TEST_UNSET_ENV"},
+		{BlockPath: []string{"needs command"}, Reason: "requires command dex-test-no-such-command on PATH"},
+		{BlockPath: []string{"prod only"}, Reason: `condition "stage == \"prod\"" is false`},
+	}
+
+	for _, test := range tests {
+
+		VarCfgs = map[string]VarCfg{}
+		initVars(dexFile.Vars)
+
+		_, err := initBlockFromPath(dexFile, test.BlockPath)
+
+		if len(test.Reason) == 0 {
+			assert.NoError(t, err, test.BlockPath)
+			continue
+		}
+
+		var guardErr *BlockGuardError
+		if assert.ErrorAs(t, err, &guardErr, test.BlockPath) {
+			assert.Equal(t, test.Reason, guardErr.Reason)
+		}
+	}
+}
+
+func TestForVarsCondition(t *testing.T) {
+
+	tests := []DexTest{
+		{
+			Name: "condition per iteration",
+			Config: `---
+version: 2
+vars:
+  hosts: [web1, skip, web3]
+blocks:
+  - name: loop_condition
+    desc: this is a command description
+    commands:
+      - exec: echo [% index %] [% var %]
+        for-vars: hosts
+        condition: var != "skip"
+      - exec: echo shell [% var %]
+        for-vars: hosts
+        condition-shell: "[% var %] != skip"
+`,
+			BlockPath:  []string{"loop_condition"},
+			CommandOut: "0 web1\n2 web3\nshell web1\nshell web3\n",
+		},
+		{
+			Name: "skip-if and only-if",
+			Config: `---
+version: 2
+blocks:
+  - name: loop_condition
+    desc: this is a command description
+    commands:
+      - exec: echo only [% var %]
+        for-vars: [1, 2, 3, 4]
+        only-if: var > 2
+      - exec: echo skip [% var %]
+        for-vars: [1, 2, 3, 4]
+        skip-if: index == 0 || var == 4
+`,
+			BlockPath:  []string{"loop_condition"},
+			CommandOut: "only 3\nonly 4\nskip 2\nskip 3\n",
+		},
+	}
+
+	for _, test := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+		}
+
+		processBlock(block, config)
+
+		assert.Equal(t, test.CommandOut, output.String())
+	}
+}
+
+func TestVerboseSkipped(t *testing.T) {
+
+	test := DexTest{
+		Config: `---
+version: 2
+blocks:
+  - name: verbose
+    desc: this is a command description
+    commands:
+      - exec: echo [% var %]
+        for-vars: [one, two, three]
+        skip-if: var != "two"
+      - exec: echo never
+        condition: false
+`,
+		BlockPath: []string{"verbose"},
+	}
+
+	block, tDexFile, err := setupTestBlock(t, test)
+
+	defer os.Remove(tDexFile.Name())
+
+	if err := check(t, err, "error setting up test"); err != nil {
+		return
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	config := ExecConfig{
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+		Verbose: true,
+	}
+
+	processBlock(block, config)
+
+	assert.Equal(t, "two\n", stdout.String())
+	assert.Equal(t, `dex: skipped 2 of 3 iterations of "echo [% var %]": index 0 (var=one), index 2 (var=three)
+dex: skipped "echo never"
+`, stderr.String())
+}
+
+func TestLoops(t *testing.T) {
+
+	tests := []DexTest{
+		{
+			Name: "named loop variable",
+			Config: `---
+version: 2
+vars:
+  hosts: [web1, web2]
+blocks:
+  - name: loops
+    desc: this is a command description
+    commands:
+      - exec: echo [% index %] [% host %]
+        for: host in hosts
+      - exec: echo [% size %]
+        for: size in ["small", "large"]
+`,
+			BlockPath:  []string{"loops"},
+			CommandOut: "0 web1\n1 web2\nsmall\nlarge\n",
+		},
+		{
+			Name: "command matrix",
+			Config: `---
+version: 2
+blocks:
+  - name: loops
+    desc: this is a command description
+    commands:
+      - exec: echo [% index %] [% os %]-[% arch %] [% cgo %]
+        matrix:
+          os: [linux, darwin]
+          arch: [amd64, arm64]
+          exclude:
+            - os: darwin
+              arch: amd64
+          include:
+            - os: linux
+              arch: amd64
+              cgo: 1
+            - os: windows
+              arch: amd64
+`,
+			BlockPath:  []string{"loops"},
+			CommandOut: "0 linux-amd64 1\n1 linux-arm64\n2 darwin-arm64\n3 windows-amd64\n",
+		},
+		{
+			Name: "matrix from variables",
+			Config: `---
+version: 2
+vars:
+  versions: ["1.21", "1.22"]
+blocks:
+  - name: loops
+    desc: this is a command description
+    commands:
+      - exec: echo go[% go %] [% mode %]
+        matrix:
+          go: versions
+          mode: [race]
+        skip-if: go == "1.21"
+`,
+			BlockPath:  []string{"loops"},
+			CommandOut: "go1.22 race\n",
+		},
+		{
+			Name: "block loop",
+			Config: `---
+version: 2
+vars:
+  hosts:
+    - name: web1
+      ports: [80, 443]
+    - name: web2
+      ports: [8080]
+blocks:
+  - name: loops
+    desc: this is a command description
+    for: host in hosts
+    commands:
+      - diag: "[% host.name %]"
+      - exec: echo [% host.name %]:[% port %]
+        for: port in host.ports
+`,
+			BlockPath:  []string{"loops"},
+			CommandOut: "web1\nweb1:80\nweb1:443\nweb2\nweb2:8080\n",
+		},
+		{
+			Name: "block matrix with for-vars",
+			Config: `---
+version: 2
+blocks:
+  - name: loops
+    desc: this is a command description
+    matrix:
+      target: [a, b]
+    commands:
+      - exec: echo [% target %] [% var %]
+        for-vars: [1, 2]
+`,
+			BlockPath:  []string{"loops"},
+			CommandOut: "a 1\na 2\nb 1\nb 2\n",
+		},
+		{
+			Name: "commands without a loop",
+			Config: `---
+version: 2
+blocks:
+  - name: loops
+    desc: this is a command description
+    commands:
+      - exec: echo [% index %] [% var %]
+        condition: index == 0
+`,
+			BlockPath:  []string{"loops"},
+			CommandOut: "0 1\n",
+		},
+		{
+			Name: "block loop with commands without a loop",
+			Config: `---
+version: 2
+blocks:
+  - name: loops
+    desc: this is a command description
+    for-vars: [a, b]
+    commands:
+      - exec: echo [% index %] [% var %]
+`,
+			BlockPath:  []string{"loops"},
+			CommandOut: "0 a\n1 b\n",
+		},
+		{
+			Name: "invalid loops",
+			Config: `---
+version: 2
+blocks:
+  - name: loops
+    desc: this is a command description
+    commands:
+      - exec: echo [% host %]
+        for: hosts
+      - exec: echo [% var %]
+        for-vars: missing_list
+      - exec: echo done
+`,
+			BlockPath:  []string{"loops"},
+			CommandOut: "dex: for: expected \"name in list\" but found \"hosts\"\ndex: for-vars: missing_list is not a list\ndone\n",
+		},
+	}
+
+	for _, test := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+		}
+
+		processBlock(block, config)
+
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+	}
+}
+
+func TestRegister(t *testing.T) {
+
+	tests := []DexTest{
+		{
+			Name: "register output",
+			Config: `---
+version: 2
+blocks:
+  - name: register
+    desc: this is a command description
+    commands:
+      - exec: printf '  abc123\n\n'
+        register: build_id
+      - exec: echo build [% build_id %]
+      - exec: echo release
+        condition: build_id == "abc123"
+`,
+			BlockPath:  []string{"register"},
+			CommandOut: "build abc123\nrelease\n",
+		},
+		{
+			Name: "register exit code",
+			Config: `---
+version: 2
+blocks:
+  - name: register
+    desc: this is a command description
+    commands:
+      - exec: exit 3
+        register-exit-code: missing
+      - exec: echo missing [% missing %]
+        condition: missing == 3
+`,
+			BlockPath:  []string{"register"},
+			CommandOut: "missing 3\n",
+		},
+		{
+			Name: "register loop",
+			Config: `---
+version: 2
+blocks:
+  - name: register
+    desc: this is a command description
+    commands:
+      - exec: echo host-[% var %]
+        for-vars: [one, two, three]
+        skip-if: var == "two"
+        register: hosts
+      - exec: echo [% hosts %] [% hosts.1 %]
+      - exec: echo [% host %]
+        for: host in hosts
+`,
+			BlockPath:  []string{"register"},
+			CommandOut: "host-one host-three host-three\nhost-one\nhost-three\n",
+		},
+	}
+
+	for _, test := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+		}
+
+		assert.Equal(t, 0, processBlock(block, config), test.Name)
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+	}
+}
+
+func TestRunBlock(t *testing.T) {
+
+	tests := []struct {
+		DexTest
+		Exit int
+	}{
+		{
+			DexTest: DexTest{
+				Name: "run with overrides",
+				Config: `---
+version: 2
+vars:
+  target: local
+blocks:
+  - name: build
+    desc: this is a command description
+    vars:
+      arch: amd64
+    commands:
+      - exec: echo build [% arch %] for [% target %]
+  - name: release
+    desc: this is a command description
+    commands:
+      - exec: echo release
+        register: stage
+      - run: build
+      - run: build
+        with:
+          arch: arm64
+          target: "[% stage %]"
+      - exec: echo [% arch %]
+`,
+				BlockPath:  []string{"release"},
+				CommandOut: "build amd64 for local\nbuild arm64 for release\n\n",
+			},
+		},
+		{
+			DexTest: DexTest{
+				Name: "run child block in a loop",
+				Config: `---
+version: 2
+blocks:
+  - name: deploy
+    desc: this is a command description
+    children:
+      - name: host
+        desc: this is a command description
+        commands:
+          - exec: echo deploy [% var %]
+  - name: all
+    desc: this is a command description
+    commands:
+      - run: [deploy, host]
+        for-vars: [web1, web2]
+`,
+				BlockPath:  []string{"all"},
+				CommandOut: "deploy web1\ndeploy web2\n",
+			},
+		},
+		{
+			DexTest: DexTest{
+				Name: "failing block",
+				Config: `---
+version: 2
+blocks:
+  - name: fail
+    desc: this is a command description
+    commands:
+      - exec: exit 3
+  - name: caller
+    desc: this is a command description
+    commands:
+      - run: fail
+      - exec: echo after
+      - run: missing
+`,
+				BlockPath:  []string{"caller"},
+				CommandOut: "after\ndex: cannot run [missing]: no such block\n",
+			},
+			Exit: 1,
+		},
+		{
+			DexTest: DexTest{
+				Name: "recursion",
+				Config: `---
+version: 2
+blocks:
+  - name: one
+    desc: this is a command description
+    commands:
+      - run: two
+  - name: two
+    desc: this is a command description
+    commands:
+      - exec: echo two
+      - run: one
+`,
+				BlockPath:  []string{"one"},
+				CommandOut: "two\ndex: recursive run of [one]: one -> two -> one\n",
+			},
+			Exit: 1,
+		},
+		{
+			DexTest: DexTest{
+				Name: "empty path",
+				Config: `---
+version: 2
+blocks:
+  - name: caller
+    desc: this is a command description
+    commands:
+      - run: "[% target %]"
+      - run: " "
+`,
+				BlockPath:  []string{"caller"},
+				CommandOut: "dex: run needs a block path\ndex: run needs a block path\n",
+			},
+			Exit: 1,
+		},
+	}
+
+	for _, test := range tests {
+
+		dexFile, err := ParseConfig([]byte(test.Config))
+		if err := check(t, err, "Error parsing config"); err != nil {
+			continue
+		}
+
+		VarCfgs = map[string]VarCfg{}
+
+		initVars(dexFile.Vars)
+
+		block, err := initBlockFromPath(dexFile, test.BlockPath)
+		if err := check(t, err, "Error resolving command"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+			File:   &dexFile,
+			Calls:  []string{strings.Join(test.BlockPath, " ")},
+		}
+
+		assert.Equal(t, test.Exit, processBlock(block, config), test.Name)
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+
+	tests := []struct {
+		DexTest
+		Exit int
+	}{
+		{
+			DexTest: DexTest{
+				Name: "command timeout",
+				Config: `---
+version: 2
+blocks:
+  - name: timeouts
+    desc: this is a command description
+    commands:
+      - exec: echo start
+      - exec: sleep 5
+        timeout: 100ms
+      - exec: echo never
+`,
+				BlockPath:  []string{"timeouts"},
+				CommandOut: "start\ndex: timed out after 100ms: sleep 5\n",
+			},
+			Exit: ExitTimeout,
+		},
+		{
+			DexTest: DexTest{
+				Name: "block timeout",
+				Config: `---
+version: 2
+blocks:
+  - name: timeouts
+    desc: this is a command description
+    timeout: 0.1
+    commands:
+      - exec: sleep [% var %]
+        for-vars: [5, 6]
+`,
+				BlockPath:  []string{"timeouts"},
+				CommandOut: "dex: timed out after 100ms: sleep 5\n",
+			},
+			Exit: ExitTimeout,
+		},
+		{
+			DexTest: DexTest{
+				Name: "failed command",
+				Config: `---
+version: 2
+blocks:
+  - name: timeouts
+    desc: this is a command description
+    timeout: 1m
+    commands:
+      - exec: exit 3
+      - exec: echo still runs
+`,
+				BlockPath:  []string{"timeouts"},
+				CommandOut: "still runs\n",
+			},
+			Exit: 3,
+		},
+	}
+
+	for _, test := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test.DexTest)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+		}
+
+		start := time.Now()
+
+		assert.Equal(t, test.Exit, processBlock(block, config), test.Name)
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+		assert.Less(t, time.Since(start), 3*time.Second, test.Name)
+	}
+}
+
+func TestFinally(t *testing.T) {
+
+	tests := []struct {
+		DexTest
+		Exit int
+	}{
+		{
+			DexTest: DexTest{
+				Name: "finally after success",
+				Config: `---
+version: 2
+blocks:
+  - name: cleanup
+    desc: this is a command description
+    commands:
+      - exec: echo up
+    on-failure:
+      - exec: echo never
+    finally:
+      - exec: echo down [% exit_code %]
+`,
+				BlockPath:  []string{"cleanup"},
+				CommandOut: "up\ndown 0\n",
+			},
+		},
+		{
+			DexTest: DexTest{
+				Name: "failure handlers",
+				Config: `---
+version: 2
+blocks:
+  - name: cleanup
+    desc: this is a command description
+    commands:
+      - exec: echo abc
+        register: container
+      - exec: exit 4
+      - exec: echo after
+    on-failure:
+      - exec: "echo failed: [% failed_command %] with [% exit_code %]"
+    finally:
+      - exec: echo remove [% container %]
+      - exec: echo only on failure
+        condition: exit_code != 0
+`,
+				BlockPath:  []string{"cleanup"},
+				CommandOut: "after\nfailed: exit 4 with 4\nremove abc\nonly on failure\n",
+			},
+			Exit: 4,
+		},
+		{
+			DexTest: DexTest{
+				Name: "finally after timeout",
+				Config: `---
+version: 2
+blocks:
+  - name: cleanup
+    desc: this is a command description
+    timeout: 100ms
+    commands:
+      - exec: sleep 5
+    finally:
+      - exec: echo down [% exit_code %]
+`,
+				BlockPath:  []string{"cleanup"},
+				CommandOut: "dex: timed out after 100ms: sleep 5\ndown 124\n",
+			},
+			Exit: ExitTimeout,
+		},
+		{
+			DexTest: DexTest{
+				Name: "failing cleanup",
+				Config: `---
+version: 2
+blocks:
+  - name: cleanup
+    desc: this is a command description
+    commands:
+      - exec: echo up
+    finally:
+      - exec: exit 2
+      - exec: echo down
+`,
+				BlockPath:  []string{"cleanup"},
+				CommandOut: "up\ndown\n",
+			},
+			Exit: 2,
+		},
+	}
+
+	for _, test := range tests {
+
+		block, tDexFile, err := setupTestBlock(t, test.DexTest)
+
+		defer os.Remove(tDexFile.Name())
+
+		if err := check(t, err, "error setting up test"); err != nil {
+			continue
+		}
+
+		var output bytes.Buffer
+
+		config := ExecConfig{
+			Stdout: &output,
+			Stderr: &output,
+		}
+
+		assert.Equal(t, test.Exit, processBlock(block, config), test.Name)
+		assert.Equal(t, test.CommandOut, output.String(), test.Name)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+
+	tests := map[string]time.Duration{
+		"":      0,
+		"30":    30 * time.Second,
+		"0.5":   500 * time.Millisecond,
+		"1m30s": 90 * time.Second,
+	}
+
+	for timeout, expected := range tests {
+		duration, err := parseTimeout(timeout)
+
+		assert.NoError(t, err, timeout)
+		assert.Equal(t, expected, duration, timeout)
+	}
+
+	_, err := parseTimeout("soon")
+	assert.EqualError(t, err, `invalid timeout "soon"`)
+}
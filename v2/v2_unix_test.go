@@ -0,0 +1,89 @@
+//go:build unix
+
+package v2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterrupt(t *testing.T) {
+
+	test := DexTest{
+		Config: `---
+version: 2
+blocks:
+  - name: interrupt
+    desc: this is a command description
+    commands:
+      - exec: sleep 5
+      - exec: echo never
+    finally:
+      - exec: echo cleanup [% exit_code %]
+`,
+		BlockPath: []string{"interrupt"},
+	}
+
+	block, tDexFile, err := setupTestBlock(t, test)
+
+	defer os.Remove(tDexFile.Name())
+
+	if err := check(t, err, "error setting up test"); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(100*time.Millisecond, func() { cancel(&InterruptError{Signal: syscall.SIGTERM}) })
+
+	var output bytes.Buffer
+
+	config := ExecConfig{
+		Stdout:  &output,
+		Stderr:  &output,
+		Context: ctx,
+	}
+
+	assert.Equal(t, 128+int(syscall.SIGTERM), processBlock(block, config))
+	assert.Equal(t, "dex: interrupted by terminated: sleep 5\ncleanup 143\n", output.String())
+}
+
+func TestTimeoutProcessGroup(t *testing.T) {
+
+	leaked := filepath.Join(t.TempDir(), "leaked")
+
+	test := DexTest{
+		Config: `---
+version: 2
+blocks:
+  - name: timeout
+    desc: this is a command description
+    commands:
+      - exec: sh -c '(sleep 0.5; touch ` + leaked + `) & wait'
+        timeout: 100ms
+`,
+		BlockPath: []string{"timeout"},
+	}
+
+	block, tDexFile, err := setupTestBlock(t, test)
+
+	defer os.Remove(tDexFile.Name())
+
+	if err := check(t, err, "error setting up test"); err != nil {
+		return
+	}
+
+	var output bytes.Buffer
+
+	assert.Equal(t, ExitTimeout, processBlock(block, ExecConfig{Stdout: &output, Stderr: &output}))
+
+	/* What the shell started in the background is stopped with it */
+	time.Sleep(time.Second)
+	assert.NoFileExists(t, leaked)
+}
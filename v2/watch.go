@@ -0,0 +1,382 @@
+package v2
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/* How long changes have to settle before dex watch reruns the block */
+const DefaultDebounce = 200 * time.Millisecond
+
+/* How often the files are polled when inotify is not available */
+const DefaultPollInterval = 500 * time.Millisecond
+
+/* Cause of the cancel of a run that is restarted for changed files */
+var errFilesChanged = errors.New("watched files changed")
+
+/* Moves the cursor home and clears the screen and its scrollback */
+const clearScreen = "\033[H\033[2J\033[3J"
+
+/*
+Matches the paths dex watch reruns a block for: files matching any of the
+include patterns, unless they match an exclude pattern.  Patterns are
+relative to dir and ** matches any number of directories.
+*/
+type fileMatcher struct {
+	dir     string
+	include []string
+	exclude []string
+
+	includeRes []*regexp.Regexp
+	excludeRes []*regexp.Regexp
+}
+
+func newFileMatcher(dir string, include []string, exclude []string) (fileMatcher, error) {
+
+	matcher := fileMatcher{dir: dir}
+
+	for _, list := range []struct {
+		patterns []string
+		abs      *[]string
+		res      *[]*regexp.Regexp
+	}{
+		{include, &matcher.include, &matcher.includeRes},
+		{exclude, &matcher.exclude, &matcher.excludeRes},
+	} {
+		for _, pattern := range list.patterns {
+
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(dir, pattern)
+			}
+
+			re, err := globRegexp(pattern)
+			if err != nil {
+				return fileMatcher{}, err
+			}
+
+			*list.abs = append(*list.abs, pattern)
+			*list.res = append(*list.res, re)
+		}
+	}
+
+	return matcher, nil
+}
+
+func (matcher fileMatcher) match(path string) bool {
+
+	for _, re := range matcher.excludeRes {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+
+	for _, re := range matcher.includeRes {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* A directory to watch, and whether its subdirectories are watched too */
+type watchRoot struct {
+	dir       string
+	recursive bool
+}
+
+/*
+The directories that hold the files of the include patterns: the last
+directory before a wildcard, with its subdirectories when a wildcard
+spans directories.
+*/
+func (matcher fileMatcher) roots() []watchRoot {
+
+	roots := []watchRoot{}
+
+	for _, pattern := range matcher.include {
+
+		wildcard := strings.IndexAny(pattern, "*?[")
+		if wildcard < 0 {
+			roots = append(roots, watchRoot{dir: filepath.Dir(pattern)})
+			continue
+		}
+
+		split := strings.LastIndex(pattern[:wildcard], string(filepath.Separator))
+
+		roots = append(roots, watchRoot{
+			dir:       pattern[:split+1],
+			recursive: strings.Contains(pattern[split+1:], string(filepath.Separator)),
+		})
+	}
+
+	return roots
+}
+
+/*
+Send the path of a changed file matching the patterns on changes until
+ctx is done.  Changes are noticed with inotify where it is available and
+by polling at the interval otherwise, or when the interval is set.
+*/
+func watchFiles(ctx context.Context, matcher fileMatcher, interval time.Duration) (<-chan string, error) {
+
+	changes := make(chan string, 1)
+
+	if interval <= 0 {
+		if err := watchNotify(ctx, matcher, changes); err == nil {
+			return changes, nil
+		}
+
+		interval = DefaultPollInterval
+	}
+
+	go pollFiles(ctx, matcher, interval, changes)
+
+	return changes, nil
+}
+
+/* Report a change, unless one is already waiting to be picked up */
+func notifyChange(changes chan<- string, path string) {
+
+	select {
+	case changes <- path:
+	default:
+	}
+}
+
+/* Compare the modification times and sizes of the files at every interval */
+func pollFiles(ctx context.Context, matcher fileMatcher, interval time.Duration, changes chan<- string) {
+
+	snapshot := func() map[string]string {
+		files, _ := globFiles(matcher.dir, matcher.include)
+		state := map[string]string{}
+
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil && matcher.match(file) {
+				state[file] = fmt.Sprint(info.ModTime().UnixNano(), info.Size())
+			}
+		}
+
+		return state
+	}
+
+	last := snapshot()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := snapshot()
+
+		for file, state := range current {
+			if last[file] != state {
+				notifyChange(changes, file)
+			}
+		}
+
+		for file := range last {
+			if _, ok := current[file]; !ok {
+				notifyChange(changes, file)
+			}
+		}
+
+		last = current
+	}
+}
+
+/* Wait until no change arrived for the debounce period */
+func settle(ctx context.Context, changes <-chan string, debounce time.Duration) {
+
+	for {
+		select {
+		case <-changes:
+		case <-time.After(debounce):
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+The watch builtin: run a block, and run it again whenever files matching
+its watch patterns, or its sources, change.  A run still going when files
+change is stopped first, with everything it started.  --clear clears the
+screen before every run, --debounce sets how long changes have to settle
+and --poll polls for changes instead of using inotify.
+*/
+func runWatch(dexFile DexFile2, args []string, config ExecConfig) int {
+
+	flags := flag.NewFlagSet("dex watch", flag.ContinueOnError)
+	flags.SetOutput(config.Stderr)
+	clear := flags.Bool("clear", false, "clear the screen before every run")
+	debounce := flags.Duration("debounce", DefaultDebounce, "wait for changes to settle this long before running again")
+	poll := flags.Duration("poll", 0, "poll for changes at this interval instead of using inotify")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	blockPath := flags.Args()
+
+	if len(blockPath) == 0 {
+		fmt.Fprintf(config.Stderr, "dex: watch needs a block, like dex watch test\n")
+		return 2
+	}
+
+	parent := config.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	/* Signals stop the run and the watch */
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardSignals...)
+	defer signal.Stop(signals)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			cancel(&InterruptError{Signal: sig})
+		case <-ctx.Done():
+		}
+	}()
+
+	/* Every run starts from the variables of the DexFile */
+	globals := VarCfgs
+	defer func() { VarCfgs = globals }()
+
+	initialize := func() (Block, error) {
+		VarCfgs = maps.Clone(globals)
+		return initBlockWithVars(dexFile, blockPath, VarCfgs, nil, ExecConfig{Secrets: config.Secrets})
+	}
+
+	block, err := initialize()
+	if err != nil {
+		fmt.Fprint(config.Stderr, err.Error()+"\n")
+		return 1
+	}
+
+	patterns := block.Watch
+	checkSetDefault(&patterns, block.Sources)
+
+	if len(patterns) == 0 {
+		fmt.Fprintf(config.Stderr, "dex: %v has no watch or sources patterns\n", blockPath)
+		return 1
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+		return 1
+	}
+
+	checkSetOverride(&dir, block.Dir)
+
+	/* What the block generates does not make it run again */
+	matcher, err := newFileMatcher(dir, patterns, block.Generates)
+	if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+		return 1
+	}
+
+	changes, err := watchFiles(ctx, matcher, *poll)
+	if err != nil {
+		fmt.Fprintf(config.Stderr, "dex: %v\n", err)
+		return 1
+	}
+
+	if config.Logger != nil && len(config.Logger.Path) > 0 {
+		if logger, err := newExecLogger(config.Logger.Path); err == nil {
+			config.Logger = logger
+			defer logger.Close()
+		} else {
+			fmt.Fprintf(config.Stderr, "dex: cannot write history: %v\n", err)
+		}
+	}
+
+	config.File = &dexFile
+	config.Calls = []string{strings.Join(blockPath, " ")}
+	config.Path = blockPath
+
+	/* A change to a watched file that is not a source would leave the block
+	   up to date, so runs after a change always run it */
+	rerun := false
+
+	for {
+
+		if *clear {
+			fmt.Fprint(config.Stdout, clearScreen)
+		}
+
+		runCtx, stop := context.WithCancelCause(ctx)
+		done := make(chan int, 1)
+		force := config.Force || rerun
+
+		go func() {
+			runConfig := config
+			runConfig.Context = runCtx
+			runConfig.Force = force
+
+			block, err := initialize()
+			if err != nil {
+				fmt.Fprint(config.Stderr, err.Error()+"\n")
+				done <- 1
+				return
+			}
+
+			done <- processBlock(block, runConfig)
+		}()
+
+		finished := false
+
+		select {
+		case exit := <-done:
+			finished = true
+			fmt.Fprintf(config.Stderr, "dex: %v %s, watching for changes\n", blockPath, describeExit(exit))
+
+			select {
+			case <-changes:
+			case <-ctx.Done():
+			}
+
+		case <-changes:
+		case <-ctx.Done():
+		}
+
+		settle(ctx, changes, *debounce)
+
+		if ctx.Err() == nil {
+			fmt.Fprintf(config.Stderr, "dex: files changed, running %v again\n", blockPath)
+		}
+
+		stop(errFilesChanged)
+		rerun = true
+
+		if !finished {
+			<-done
+		}
+
+		if ctx.Err() != nil {
+			return cancelExitCode(context.Cause(ctx))
+		}
+	}
+}
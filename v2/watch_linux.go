@@ -0,0 +1,113 @@
+//go:build linux
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/* Events that mean a file was written, created, removed or renamed */
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+/*
+Watch the directories of the patterns with inotify, adding directories
+created below recursive roots as they appear.  Fails when inotify is not
+available or none of the directories exist yet, so the caller can poll.
+*/
+func watchNotify(ctx context.Context, matcher fileMatcher, changes chan<- string) error {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	/* Non-blocking, so reads go through the poller and Close ends them */
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	watched := map[int]watchRoot{}
+
+	add := func(root watchRoot) {
+		filepath.WalkDir(root.dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.IsDir() {
+				return nil
+			}
+
+			if path != root.dir && (!root.recursive || entry.Name() == ".git") {
+				return filepath.SkipDir
+			}
+
+			if wd, err := syscall.InotifyAddWatch(fd, path, inotifyMask); err == nil {
+				watched[wd] = watchRoot{dir: path, recursive: root.recursive}
+			}
+
+			return nil
+		})
+	}
+
+	for _, root := range matcher.roots() {
+		add(root)
+	}
+
+	if len(watched) == 0 {
+		file.Close()
+		return errors.New("nothing to watch")
+	}
+
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	go func() {
+		buffer := make([]byte, 64*1024)
+
+		for {
+			n, err := file.Read(buffer)
+			if err != nil {
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				name := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				/* Events were lost, so anything may have changed */
+				if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					notifyChange(changes, matcher.dir)
+					continue
+				}
+
+				parent, ok := watched[int(event.Wd)]
+				if !ok {
+					continue
+				}
+
+				path := filepath.Join(parent.dir, strings.TrimRight(string(name), "\x00"))
+
+				if event.Mask&syscall.IN_ISDIR != 0 {
+					if parent.recursive && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+						add(watchRoot{dir: path, recursive: true})
+					}
+
+					continue
+				}
+
+				if matcher.match(path) {
+					notifyChange(changes, path)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package v2
+
+import (
+	"context"
+	"errors"
+)
+
+/* inotify is only available on Linux, elsewhere the files are polled */
+func watchNotify(ctx context.Context, matcher fileMatcher, changes chan<- string) error {
+	return errors.New("inotify is not available")
+}
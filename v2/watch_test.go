@@ -0,0 +1,288 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMatcher(t *testing.T) {
+
+	matcher, err := newFileMatcher("/src", []string{"*.go", "cmd/**/*.go", "/etc/dex.yml"}, []string{"*_gen.go"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		Path     string
+		Expected bool
+	}{
+		{"/src/main.go", true},
+		{"/src/main_gen.go", false},
+		{"/src/v2/v2.go", false},
+		{"/src/cmd/dex/main.go", true},
+		{"/src/cmd/main.go", true},
+		{"/src/README.md", false},
+		{"/etc/dex.yml", true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.Expected, matcher.match(test.Path), test.Path)
+	}
+
+	assert.Equal(t, []watchRoot{
+		{dir: "/src/"},
+		{dir: "/src/cmd/", recursive: true},
+		{dir: "/etc"},
+	}, matcher.roots())
+}
+
+/* A buffer that can be read while commands write to it */
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (buffer *syncBuffer) Write(data []byte) (int, error) {
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.Write(data)
+}
+
+func (buffer *syncBuffer) String() string {
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.String()
+}
+
+/* Number of lines of output that are exactly line, after clearing the screen */
+func countLines(output string, line string) int {
+	return strings.Count("\n"+strings.ReplaceAll(output, clearScreen, ""), "\n"+line+"\n")
+}
+
+func TestWatch(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: test
+    desc: this is a command description
+    watch: ["src/**/*.txt"]
+    generates: [src/out.txt]
+    commands:
+      - exec: echo started; cat src/a.txt > src/out.txt; sleep [% sleep %]; echo finished
+`
+
+	tests := []struct {
+		Name  string
+		Args  []string
+		Sleep string
+		Runs  int
+	}{
+		{
+			Name:  "inotify",
+			Args:  []string{"--debounce", "50ms", "test"},
+			Sleep: "0",
+			Runs:  3,
+		},
+		{
+			Name:  "poll",
+			Args:  []string{"--poll", "20ms", "--debounce", "50ms", "--clear", "test"},
+			Sleep: "0",
+			Runs:  3,
+		},
+		{
+			Name:  "restart",
+			Args:  []string{"--debounce", "50ms", "test"},
+			Sleep: "10",
+			Runs:  3,
+		},
+	}
+
+	for _, test := range tests {
+
+		dir := t.TempDir()
+		os.MkdirAll(filepath.Join(dir, "src", "lib"), 0755)
+		os.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("a\n"), 0644)
+
+		dexFile, err := ParseConfig([]byte(config))
+		if !assert.NoError(t, err, test.Name) {
+			continue
+		}
+
+		VarCfgs = map[string]VarCfg{
+			"sleep": {Type: StringVar, StringValue: test.Sleep},
+		}
+
+		cwd, _ := os.Getwd()
+		os.Chdir(dir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var output syncBuffer
+		done := make(chan int, 1)
+
+		go func() {
+			done <- runWatch(dexFile, test.Args, ExecConfig{
+				Stdout:      &output,
+				Stderr:      &output,
+				Context:     ctx,
+				GracePeriod: 100 * time.Millisecond,
+			})
+		}()
+
+		/* Wait for each run to start before changing a file */
+		waitFor := func(runs int) bool {
+			return assert.Eventually(t, func() bool {
+				return countLines(output.String(), "started") >= runs
+			}, 5*time.Second, 10*time.Millisecond, test.Name)
+		}
+
+		if waitFor(1) {
+			time.Sleep(100 * time.Millisecond)
+			os.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("b\n"), 0644)
+		}
+
+		if waitFor(2) {
+			time.Sleep(100 * time.Millisecond)
+			os.WriteFile(filepath.Join(dir, "src", "lib", "c.txt"), []byte("c\n"), 0644)
+		}
+
+		waitFor(test.Runs)
+
+		/* The output file is generated, writing it is not a change */
+		time.Sleep(300 * time.Millisecond)
+
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: watch did not stop", test.Name)
+		}
+
+		os.Chdir(cwd)
+
+		assert.Equal(t, test.Runs, countLines(output.String(), "started"), test.Name)
+
+		if test.Sleep == "0" {
+			assert.Equal(t, test.Runs, countLines(output.String(), "finished"), test.Name)
+			assert.Contains(t, output.String(), "dex: [test] ok, watching for changes\n", test.Name)
+		} else {
+			assert.Equal(t, 0, countLines(output.String(), "finished"), test.Name)
+		}
+
+		if strings.Contains(strings.Join(test.Args, " "), "--clear") {
+			assert.Equal(t, test.Runs, strings.Count(output.String(), clearScreen), test.Name)
+		}
+	}
+}
+
+func TestWatchWithoutPatterns(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: test
+    desc: this is a command description
+    commands:
+      - exec: echo test
+`
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	VarCfgs = map[string]VarCfg{}
+
+	var output bytes.Buffer
+
+	assert.Equal(t, 1, runWatch(dexFile, []string{"test"}, ExecConfig{Stdout: &output, Stderr: &output}))
+	assert.Equal(t, "dex: [test] has no watch or sources patterns\n", output.String())
+
+	output.Reset()
+
+	assert.Equal(t, 2, runWatch(dexFile, []string{}, ExecConfig{Stdout: &output, Stderr: &output}))
+	assert.Equal(t, "dex: watch needs a block, like dex watch test\n", output.String())
+}
+
+/* A watched file that is not a source still runs the block again */
+func TestWatchWithSources(t *testing.T) {
+
+	config := `---
+version: 2
+blocks:
+  - name: test
+    desc: this is a command description
+    watch: ["templates/*.txt"]
+    sources: ["src/*.txt"]
+    commands:
+      - exec: echo started
+`
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src"), 0755)
+	os.MkdirAll(filepath.Join(dir, "templates"), 0755)
+	os.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("a\n"), 0644)
+
+	dexFile, err := ParseConfig([]byte(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	VarCfgs = map[string]VarCfg{}
+
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var output syncBuffer
+	done := make(chan int, 1)
+
+	go func() {
+		done <- runWatch(dexFile, []string{"--debounce", "50ms", "test"}, ExecConfig{
+			Stdout:      &output,
+			Stderr:      &output,
+			Context:     ctx,
+			StateDir:    filepath.Join(dir, ".dex"),
+			GracePeriod: 100 * time.Millisecond,
+		})
+	}()
+
+	for runs := 1; runs <= 2; runs++ {
+		assert.Eventually(t, func() bool {
+			return countLines(output.String(), "started") >= runs
+		}, 5*time.Second, 10*time.Millisecond)
+
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(filepath.Join(dir, "templates", "page.txt"), []byte{byte('0' + runs)}, 0644)
+	}
+
+	assert.Eventually(t, func() bool {
+		return countLines(output.String(), "started") >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("watch did not stop")
+	}
+
+	assert.NotContains(t, output.String(), "is up to date")
+}